@@ -0,0 +1,413 @@
+// Package alert posts webhook notifications about bursts of blocked
+// requests. An Alerter is an event.Sink, blocked events are grouped by
+// host, path and client IP over a window and each window is posted as one
+// JSON batch.
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chaitin/t1k-go/event"
+	"github.com/chaitin/t1k-go/misc"
+)
+
+const (
+	DEFAULT_WINDOW       = time.Minute
+	DEFAULT_MAX_GROUPS   = 1000
+	DEFAULT_MAX_RETRIES  = 3
+	DEFAULT_BACKOFF      = time.Second
+	DEFAULT_MAX_BACKOFF  = time.Minute
+	DEFAULT_TIMEOUT      = 10 * time.Second
+	DEFAULT_BUFFER_SIZE  = 1024
+	DEFAULT_QUEUE_LENGTH = 16
+
+	maxEventIDs = 10
+)
+
+type Config struct {
+	URLs        []string
+	Header      http.Header   // added to every POST, like an authorization token
+	Window      time.Duration // default 1 minute
+	MinCount    int           // groups with fewer blocks in a window are not posted
+	MaxGroups   int           // groups kept per window, others are counted as dropped
+	MaxRetries  int           // default 3, negative to disable
+	Backoff     time.Duration // first retry delay, doubled on each retry
+	MaxBackoff  time.Duration
+	MinInterval time.Duration // least time between two posts to one webhook
+	Timeout     time.Duration // of one POST, when Client is nil
+	Client      *http.Client
+	BufferSize  int // events queued before dropping
+	QueueLength int // batches queued per webhook before dropping
+	ErrorHook   func(error)
+}
+
+// Group is the blocks of one host, path and client IP within a window.
+type Group struct {
+	Host        string    `json:"host"`
+	Path        string    `json:"path"`
+	ClientIP    string    `json:"client_ip"`
+	Count       int       `json:"count"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	EventIDs    []string  `json:"event_ids,omitempty"` // the first few only
+	AttackTypes []string  `json:"attack_types,omitempty"`
+}
+
+// Batch is the body posted to the webhooks.
+type Batch struct {
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+	Total       int       `json:"total"`
+	Groups      []*Group  `json:"groups"`
+	// blocks not in Groups as MaxGroups was reached
+	Dropped int `json:"dropped,omitempty"`
+}
+
+type Stats struct {
+	Events        uint64 // blocked events aggregated
+	DroppedEvents uint64 // events lost as the buffer was full
+	Sent          uint64 // batches delivered
+	Failed        uint64 // batches given up after retries or dropped
+}
+
+type key struct {
+	host, path, clientIP string
+}
+
+type window struct {
+	start   time.Time
+	groups  map[key]*Group
+	total   int
+	dropped int
+}
+
+type Alerter struct {
+	// accessed atomically, kept first for alignment
+	events        uint64
+	droppedEvents uint64
+	sent          uint64
+	failed        uint64
+
+	config    *Config
+	client    *http.Client
+	ch        chan *event.Event
+	closeCh   chan struct{}
+	doneCh    chan struct{}
+	hooks     []*webhook
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func New(config *Config) (*Alerter, error) {
+	if len(config.URLs) == 0 {
+		return nil, errors.New("no webhook url")
+	}
+	client := config.Client
+	if client == nil {
+		timeout := config.Timeout
+		if timeout <= 0 {
+			timeout = DEFAULT_TIMEOUT
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DEFAULT_BUFFER_SIZE
+	}
+	queueLength := config.QueueLength
+	if queueLength <= 0 {
+		queueLength = DEFAULT_QUEUE_LENGTH
+	}
+	ret := &Alerter{
+		config:  config,
+		client:  client,
+		ch:      make(chan *event.Event, bufferSize),
+		closeCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	for _, url := range config.URLs {
+		h := &webhook{
+			alerter: ret,
+			url:     url,
+			ch:      make(chan []byte, queueLength),
+		}
+		ret.hooks = append(ret.hooks, h)
+		ret.wg.Add(1)
+		go h.run()
+	}
+	go ret.run()
+	return ret, nil
+}
+
+// Emit queues blocked events, others are ignored.
+func (a *Alerter) Emit(e *event.Event) {
+	if !e.Blocked() {
+		return
+	}
+	select {
+	case a.ch <- e:
+	default:
+		atomic.AddUint64(&a.droppedEvents, 1)
+	}
+}
+
+func (a *Alerter) OnlyBlocked() bool {
+	return true
+}
+
+func (a *Alerter) Stats() Stats {
+	return Stats{
+		Events:        atomic.LoadUint64(&a.events),
+		DroppedEvents: atomic.LoadUint64(&a.droppedEvents),
+		Sent:          atomic.LoadUint64(&a.sent),
+		Failed:        atomic.LoadUint64(&a.failed),
+	}
+}
+
+// Close posts the current window and waits for the queued batches, which
+// are not retried any more. Emit must not be called afterwards.
+func (a *Alerter) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.ch)
+		<-a.doneCh
+		close(a.closeCh)
+		for _, h := range a.hooks {
+			close(h.ch)
+		}
+	})
+	a.wg.Wait()
+	return nil
+}
+
+func (a *Alerter) onErr(err error) {
+	if err != nil && a.config.ErrorHook != nil {
+		a.config.ErrorHook(err)
+	}
+}
+
+func (a *Alerter) windowSize() time.Duration {
+	if a.config.Window <= 0 {
+		return DEFAULT_WINDOW
+	}
+	return a.config.Window
+}
+
+func newWindow() *window {
+	return &window{
+		start:  time.Now(),
+		groups: make(map[key]*Group),
+	}
+}
+
+func (a *Alerter) add(w *window, e *event.Event) {
+	e.Decode()
+	atomic.AddUint64(&a.events, 1)
+	w.total++
+	k := key{e.Host, e.Path, e.RemoteAddr}
+	g, ok := w.groups[k]
+	if !ok {
+		maxGroups := a.config.MaxGroups
+		if maxGroups <= 0 {
+			maxGroups = DEFAULT_MAX_GROUPS
+		}
+		if len(w.groups) >= maxGroups {
+			w.dropped++
+			return
+		}
+		g = &Group{
+			Host:      e.Host,
+			Path:      e.Path,
+			ClientIP:  e.RemoteAddr,
+			FirstSeen: e.Time,
+		}
+		w.groups[k] = g
+	}
+	g.Count++
+	g.LastSeen = e.Time
+	if e.EventID != "" && len(g.EventIDs) < maxEventIDs {
+		g.EventIDs = append(g.EventIDs, e.EventID)
+	}
+	if e.Attack != nil && e.Attack.AttackType != "" {
+		for _, t := range g.AttackTypes {
+			if t == e.Attack.AttackType {
+				return
+			}
+		}
+		g.AttackTypes = append(g.AttackTypes, e.Attack.AttackType)
+	}
+}
+
+// batch returns nil when no group reaches MinCount.
+func (a *Alerter) batch(w *window) *Batch {
+	ret := &Batch{
+		WindowStart: w.start,
+		WindowEnd:   time.Now(),
+		Total:       w.total,
+		Dropped:     w.dropped,
+	}
+	for _, g := range w.groups {
+		if g.Count >= a.config.MinCount {
+			ret.Groups = append(ret.Groups, g)
+		}
+	}
+	if len(ret.Groups) == 0 {
+		return nil
+	}
+	sort.Slice(ret.Groups, func(i, j int) bool {
+		if ret.Groups[i].Count != ret.Groups[j].Count {
+			return ret.Groups[i].Count > ret.Groups[j].Count
+		}
+		return ret.Groups[i].FirstSeen.Before(ret.Groups[j].FirstSeen)
+	})
+	return ret
+}
+
+func (a *Alerter) flush(w *window) {
+	b := a.batch(w)
+	if b == nil {
+		return
+	}
+	body, err := json.Marshal(b)
+	if err != nil {
+		a.onErr(misc.ErrorWrap(err, ""))
+		return
+	}
+	for _, h := range a.hooks {
+		select {
+		case h.ch <- body:
+		default:
+			atomic.AddUint64(&a.failed, 1)
+			a.onErr(fmt.Errorf("webhook %s queue full, batch dropped", h.url))
+		}
+	}
+}
+
+func (a *Alerter) run() {
+	defer close(a.doneCh)
+	ticker := time.NewTicker(a.windowSize())
+	defer ticker.Stop()
+	w := newWindow()
+	for {
+		select {
+		case e, ok := <-a.ch:
+			if !ok {
+				a.flush(w)
+				return
+			}
+			a.add(w, e)
+		case <-ticker.C:
+			a.flush(w)
+			w = newWindow()
+		}
+	}
+}
+
+type webhook struct {
+	alerter  *Alerter
+	url      string
+	ch       chan []byte
+	lastPost time.Time
+}
+
+// sleep returns false when the alerter was closed meanwhile.
+func (h *webhook) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-h.alerter.closeCh:
+		return false
+	}
+}
+
+// retryAfter is the delay asked by a 429 or 503 answer, if any.
+func retryAfter(rsp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(rsp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (h *webhook) post(body []byte) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, misc.ErrorWrap(err, "")
+	}
+	for k, v := range h.alerter.config.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	h.lastPost = time.Now()
+	rsp, err := h.alerter.client.Do(req)
+	if err != nil {
+		return 0, misc.ErrorWrap(err, "post webhook")
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return 0, nil
+	}
+	return retryAfter(rsp), fmt.Errorf("webhook %s answered %d", h.url, rsp.StatusCode)
+}
+
+func (h *webhook) deliver(body []byte) {
+	config := h.alerter.config
+	backoff := config.Backoff
+	if backoff <= 0 {
+		backoff = DEFAULT_BACKOFF
+	}
+	maxBackoff := config.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	retries := config.MaxRetries
+	if retries == 0 {
+		retries = DEFAULT_MAX_RETRIES
+	}
+	for attempt := 0; ; attempt++ {
+		if !h.lastPost.IsZero() {
+			// rate limit, skipped once closed
+			h.sleep(config.MinInterval - time.Since(h.lastPost))
+		}
+		wait, err := h.post(body)
+		if err == nil {
+			atomic.AddUint64(&h.alerter.sent, 1)
+			return
+		}
+		h.alerter.onErr(err)
+		if attempt >= retries {
+			break
+		}
+		if wait < backoff {
+			wait = backoff
+		}
+		if !h.sleep(wait) {
+			break
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	atomic.AddUint64(&h.alerter.failed, 1)
+}
+
+func (h *webhook) run() {
+	defer h.alerter.wg.Done()
+	for body := range h.ch {
+		h.deliver(body)
+	}
+}
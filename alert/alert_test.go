@@ -0,0 +1,121 @@
+package alert
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/event"
+)
+
+func makeEvent(passed bool, host string, path string, ip string) *event.Event {
+	e := event.New(nil, detection.MakeLocalResult(detection.ORIGIN_DETECTOR, passed, 403))
+	e.Host = host
+	e.Path = path
+	e.RemoteAddr = ip
+	return e
+}
+
+type collector struct {
+	lock     sync.Mutex
+	failures int
+	batches  []*Batch
+	posted   chan struct{}
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	b, _ := io.ReadAll(r.Body)
+	var batch Batch
+	if err := json.Unmarshal(b, &batch); err != nil || r.Header.Get("X-Token") != "secret" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.batches = append(c.batches, &batch)
+	c.posted <- struct{}{}
+}
+
+func TestAlerterBatch(t *testing.T) {
+	c := &collector{failures: 2, posted: make(chan struct{}, 10)}
+	ts := httptest.NewServer(c)
+	defer ts.Close()
+
+	a, err := New(&Config{
+		URLs:     []string{ts.URL},
+		Header:   http.Header{"X-Token": []string{"secret"}},
+		Window:   200 * time.Millisecond,
+		MinCount: 2,
+		Backoff:  time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		a.Emit(makeEvent(false, "a.com", "/login", "192.0.2.1"))
+	}
+	a.Emit(makeEvent(false, "a.com", "/", "192.0.2.2"))
+	a.Emit(makeEvent(true, "a.com", "/login", "192.0.2.1"))
+	select {
+	case <-c.posted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch not posted")
+	}
+	a.Close()
+
+	if len(c.batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(c.batches))
+	}
+	b := c.batches[0]
+	if b.Total != 4 || len(b.Groups) != 1 {
+		t.Fatalf("unexpected batch %+v", b)
+	}
+	g := b.Groups[0]
+	if g.Host != "a.com" || g.Path != "/login" || g.ClientIP != "192.0.2.1" || g.Count != 3 {
+		t.Fatalf("unexpected group %+v", g)
+	}
+	if stats := a.Stats(); stats.Events != 4 || stats.Sent != 1 || stats.Failed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestAlerterWindowAndGiveUp(t *testing.T) {
+	c := &collector{failures: 100, posted: make(chan struct{}, 10)}
+	ts := httptest.NewServer(c)
+	defer ts.Close()
+
+	a, err := New(&Config{
+		URLs:       []string{ts.URL},
+		Window:     10 * time.Millisecond,
+		MaxRetries: 1,
+		Backoff:    time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Emit(makeEvent(false, "a.com", "/", "192.0.2.1"))
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().Failed == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch not given up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	a.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.failures != 98 {
+		t.Fatalf("expected 2 attempts, got %d", 100-c.failures)
+	}
+}
@@ -0,0 +1,300 @@
+// Package analytics answers which clients and targets are being blocked
+// right now. An Aggregator is an event.Sink counting blocked events over a
+// rolling window in space-saving sketches, so that its memory does not
+// grow with the number of distinct keys. Events are queued and counted in
+// the background, by the time they happened.
+package analytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chaitin/t1k-go/event"
+)
+
+const (
+	DEFAULT_WINDOW      = 5 * time.Minute
+	DEFAULT_BUCKETS     = 10
+	DEFAULT_CAPACITY    = 100
+	DEFAULT_TOP_N       = 10
+	DEFAULT_BUFFER_SIZE = 1024
+)
+
+type Dimension int
+
+const (
+	DIM_CLIENT_IP  Dimension = 0
+	DIM_URI        Dimension = 1
+	DIM_HOST       Dimension = 2
+	DIM_EVENT_TYPE Dimension = 3
+
+	dimCount = 4
+)
+
+func (d Dimension) String() string {
+	switch d {
+	case DIM_CLIENT_IP:
+		return "client_ip"
+	case DIM_URI:
+		return "uri"
+	case DIM_HOST:
+		return "host"
+	case DIM_EVENT_TYPE:
+		return "event_type"
+	}
+	return "unknown"
+}
+
+type Config struct {
+	Window     time.Duration // default 5 minutes
+	Buckets    int           // the window moves one bucket at a time, default 10
+	Capacity   int           // counters per dimension and bucket, default 100
+	BufferSize int           // events queued before dropping, default 1024
+}
+
+type bucket struct {
+	start    time.Time
+	total    uint64
+	sketches [dimCount]*spaceSaving
+}
+
+type Aggregator struct {
+	// accessed atomically, kept first for alignment
+	droppedEvents uint64
+
+	window   time.Duration
+	span     time.Duration
+	capacity int
+
+	lock    sync.Mutex
+	buckets []*bucket // ring, indexed by bucket start
+	now     func() time.Time
+
+	ch        chan *event.Event
+	doneCh    chan struct{}
+	closeOnce sync.Once
+}
+
+func New(config *Config) (*Aggregator, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	window := config.Window
+	if window <= 0 {
+		window = DEFAULT_WINDOW
+	}
+	buckets := config.Buckets
+	if buckets <= 0 {
+		buckets = DEFAULT_BUCKETS
+	}
+	capacity := config.Capacity
+	if capacity <= 0 {
+		capacity = DEFAULT_CAPACITY
+	}
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DEFAULT_BUFFER_SIZE
+	}
+	span := window / time.Duration(buckets)
+	if span <= 0 {
+		return nil, fmt.Errorf("window %v too short for %d buckets", window, buckets)
+	}
+	ret := &Aggregator{
+		window:   window,
+		span:     span,
+		capacity: capacity,
+		buckets:  make([]*bucket, buckets),
+		now:      time.Now,
+		ch:       make(chan *event.Event, bufferSize),
+		doneCh:   make(chan struct{}),
+	}
+	go ret.run()
+	return ret, nil
+}
+
+func eventType(e *event.Event) string {
+	if e.Attack != nil && e.Attack.AttackType != "" {
+		return e.Attack.AttackType
+	}
+	if e.Result != nil && e.Result.IsLocal() {
+		return e.Origin
+	}
+	return "unknown"
+}
+
+// bucketAt returns the bucket of t, recycling an expired one, nil when t
+// is out of the window.
+func (a *Aggregator) bucketAt(t time.Time) *bucket {
+	start := t.Truncate(a.span)
+	if start.Before(a.oldest(a.now())) {
+		return nil
+	}
+	i := int(start.UnixNano()/int64(a.span)) % len(a.buckets)
+	b := a.buckets[i]
+	if b != nil && b.start.After(start) {
+		return nil
+	}
+	if b == nil || !b.start.Equal(start) {
+		b = &bucket{start: start}
+		for d := range b.sketches {
+			b.sketches[d] = newSpaceSaving(a.capacity)
+		}
+		a.buckets[i] = b
+	}
+	return b
+}
+
+// Emit queues blocked events, others are ignored.
+func (a *Aggregator) Emit(e *event.Event) {
+	if !e.Blocked() {
+		return
+	}
+	select {
+	case a.ch <- e:
+	default:
+		atomic.AddUint64(&a.droppedEvents, 1)
+	}
+}
+
+// DroppedEvents is the number of events lost as the buffer was full.
+func (a *Aggregator) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&a.droppedEvents)
+}
+
+// Close counts the queued events. Emit must not be called afterwards, the
+// counts can still be read.
+func (a *Aggregator) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.ch)
+	})
+	<-a.doneCh
+	return nil
+}
+
+func (a *Aggregator) run() {
+	defer close(a.doneCh)
+	for e := range a.ch {
+		a.add(e)
+	}
+}
+
+func (a *Aggregator) add(e *event.Event) {
+	e.Decode()
+	keys := [dimCount]string{
+		DIM_CLIENT_IP:  e.RemoteAddr,
+		DIM_URI:        e.URI,
+		DIM_HOST:       e.Host,
+		DIM_EVENT_TYPE: eventType(e),
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	b := a.bucketAt(e.Time)
+	if b == nil {
+		return
+	}
+	b.total++
+	for d, key := range keys {
+		if key != "" {
+			b.sketches[d].add(key)
+		}
+	}
+}
+
+func (a *Aggregator) OnlyBlocked() bool {
+	return true
+}
+
+// oldest is the start of the oldest bucket in the window at now.
+func (a *Aggregator) oldest(now time.Time) time.Time {
+	return now.Truncate(a.span).Add(-a.window + a.span)
+}
+
+func (a *Aggregator) live(now time.Time) []*bucket {
+	var ret []*bucket
+	oldest := a.oldest(now)
+	for _, b := range a.buckets {
+		if b != nil && !b.start.Before(oldest) {
+			ret = append(ret, b)
+		}
+	}
+	return ret
+}
+
+// Top returns the n largest counts of d over the window, all of the
+// tracked ones when n <= 0.
+func (a *Aggregator) Top(d Dimension, n int) []Entry {
+	if d < 0 || d >= dimCount {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var sketches []*spaceSaving
+	for _, b := range a.live(a.now()) {
+		sketches = append(sketches, b.sketches[d])
+	}
+	return topN(merge(sketches), n)
+}
+
+// Total is the number of blocked events in the window.
+func (a *Aggregator) Total() uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var ret uint64
+	for _, b := range a.live(a.now()) {
+		ret += b.total
+	}
+	return ret
+}
+
+type Snapshot struct {
+	Window     string  `json:"window"`
+	Total      uint64  `json:"total"`
+	ClientIPs  []Entry `json:"client_ips"`
+	URIs       []Entry `json:"uris"`
+	Hosts      []Entry `json:"hosts"`
+	EventTypes []Entry `json:"event_types"`
+}
+
+func (a *Aggregator) Snapshot(n int) *Snapshot {
+	return &Snapshot{
+		Window:     a.window.String(),
+		Total:      a.Total(),
+		ClientIPs:  a.Top(DIM_CLIENT_IP, n),
+		URIs:       a.Top(DIM_URI, n),
+		Hosts:      a.Top(DIM_HOST, n),
+		EventTypes: a.Top(DIM_EVENT_TYPE, n),
+	}
+}
+
+// Handler serves the Snapshot as JSON, the query parameter n sets its
+// size, default 10.
+func (a *Aggregator) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n := DEFAULT_TOP_N
+		if raw := r.URL.Query().Get("n"); raw != "" {
+			v, err := strconv.Atoi(raw)
+			if err != nil || v <= 0 {
+				http.Error(w, "bad n", http.StatusBadRequest)
+				return
+			}
+			n = v
+		}
+		b, err := json.Marshal(a.Snapshot(n))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
@@ -0,0 +1,144 @@
+package analytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/event"
+)
+
+func blocked(ip string, uri string, t time.Time) *event.Event {
+	e := event.New(nil, detection.MakeLocalResult(detection.ORIGIN_IP_LIST, false, 403))
+	e.Time = t
+	e.RemoteAddr = ip
+	e.URI = uri
+	e.Host = "a.com"
+	return e
+}
+
+func TestSpaceSaving(t *testing.T) {
+	s := newSpaceSaving(3)
+	for i := 0; i < 100; i++ {
+		s.add("heavy")
+		s.add(fmt.Sprintf("noise-%d", i))
+	}
+	top := topN(s.counters, 1)
+	if top[0].Key != "heavy" || top[0].Count-top[0].Error > 100 || top[0].Count < 100 {
+		t.Fatalf("heavy hitter lost %+v", top)
+	}
+	if len(s.counters) != 3 {
+		t.Fatalf("sketch not bounded: %d", len(s.counters))
+	}
+}
+
+func TestMergeMissingKeys(t *testing.T) {
+	full := newSpaceSaving(2)
+	for _, key := range []string{"a", "a", "a", "b", "b", "c"} {
+		full.add(key)
+	}
+	// "b" was evicted by "c" and may have reached 3 in full
+	other := newSpaceSaving(2)
+	for i := 0; i < 5; i++ {
+		other.add("b")
+	}
+	merged := merge([]*spaceSaving{full, other})
+	b := merged["b"]
+	if b.Count != 8 || b.Error != 3 {
+		t.Fatalf("expected b within [5, 8], got %+v", b)
+	}
+	// other is not full, so "a" and "c" are known to be missing from it
+	if a := merged["a"]; a.Count != 3 || a.Error != 0 {
+		t.Fatalf("unexpected a %+v", a)
+	}
+}
+
+func TestAggregatorWindow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, err := New(&Config{Window: time.Minute, Buckets: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := now
+	now = now.Add(30 * time.Second)
+	a.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		a.Emit(blocked("192.0.2.1", "/login", start))
+	}
+	a.Emit(blocked("192.0.2.2", "/", start))
+	a.Emit(event.New(nil, detection.MakeLocalResult(detection.ORIGIN_IP_LIST, true, 0)))
+	a.Emit(blocked("192.0.2.2", "/", now))
+	// out of the window by the time it is counted
+	a.Emit(blocked("192.0.2.3", "/", start.Add(-time.Minute)))
+	a.Close()
+
+	top := a.Top(DIM_CLIENT_IP, 1)
+	if len(top) != 1 || top[0].Key != "192.0.2.1" || top[0].Count != 3 {
+		t.Fatalf("unexpected top %+v", top)
+	}
+	if types := a.Top(DIM_EVENT_TYPE, 0); len(types) != 1 || types[0].Key != "ip-list" || types[0].Count != 5 {
+		t.Fatalf("unexpected event types %+v", types)
+	}
+
+	// the first bucket leaves the window
+	now = now.Add(40 * time.Second)
+	if total := a.Total(); total != 1 {
+		t.Fatalf("expected 1 blocked in window, got %d", total)
+	}
+	if top := a.Top(DIM_URI, 0); len(top) != 1 || top[0].Key != "/" {
+		t.Fatalf("unexpected uris %+v", top)
+	}
+}
+
+func TestNewShortWindow(t *testing.T) {
+	if _, err := New(&Config{Window: 5, Buckets: 10}); err == nil {
+		t.Fatal("expected error for a window shorter than its buckets")
+	}
+}
+
+func TestAggregatorHandler(t *testing.T) {
+	a, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Emit(blocked("192.0.2.1", "/login", time.Now()))
+	a.Emit(blocked("192.0.2.2", "/login", time.Now()))
+	a.Close()
+
+	w := httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/?n=1", nil))
+	var s Snapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Total != 2 || len(s.ClientIPs) != 1 || len(s.URIs) != 1 || s.URIs[0].Count != 2 || s.Hosts[0].Key != "a.com" {
+		t.Fatalf("unexpected snapshot %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/?n=x", nil))
+	if w.Code != 400 {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestAggregatorDropsWhenFull(t *testing.T) {
+	a, err := New(&Config{BufferSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hold the lock so that the queue is not drained
+	a.lock.Lock()
+	for i := 0; i < 3; i++ {
+		a.Emit(blocked("192.0.2.1", "/", time.Now()))
+	}
+	a.lock.Unlock()
+	a.Close()
+	if dropped, total := a.DroppedEvents(), a.Total(); dropped == 0 || dropped+total != 3 {
+		t.Fatalf("expected the events beyond the buffer dropped, got %d dropped, %d counted", dropped, total)
+	}
+}
@@ -0,0 +1,111 @@
+package analytics
+
+import (
+	"sort"
+)
+
+// Entry is an estimated count, the true count lies in [Count-Error, Count].
+type Entry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error,omitempty"`
+}
+
+// spaceSaving keeps the heavy hitters of a stream in at most capacity
+// counters (Metwally et al.). A new key takes over the smallest counter and
+// inherits its count as error.
+type spaceSaving struct {
+	capacity int
+	counters map[string]*Entry
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		counters: make(map[string]*Entry, capacity),
+	}
+}
+
+func (s *spaceSaving) add(key string) {
+	if c, ok := s.counters[key]; ok {
+		c.Count++
+		return
+	}
+	if len(s.counters) < s.capacity {
+		s.counters[key] = &Entry{Key: key, Count: 1}
+		return
+	}
+	var min *Entry
+	for _, c := range s.counters {
+		if min == nil || c.Count < min.Count {
+			min = c
+		}
+	}
+	delete(s.counters, min.Key)
+	s.counters[key] = &Entry{Key: key, Count: min.Count + 1, Error: min.Count}
+}
+
+// min is the smallest count a key missing from s may have reached, 0 unless
+// s is full and has evicted keys.
+func (s *spaceSaving) min() uint64 {
+	if len(s.counters) < s.capacity {
+		return 0
+	}
+	var ret uint64
+	first := true
+	for _, c := range s.counters {
+		if first || c.Count < ret {
+			ret = c.Count
+			first = false
+		}
+	}
+	return ret
+}
+
+// merge adds the counters of sketches into one list, unsorted. A key
+// missing from a full sketch may have been evicted from it, so that
+// sketch's smallest count is added to both its Count and Error.
+func merge(sketches []*spaceSaving) map[string]*Entry {
+	ret := make(map[string]*Entry)
+	for _, s := range sketches {
+		for key, c := range s.counters {
+			e, ok := ret[key]
+			if !ok {
+				e = &Entry{Key: key}
+				ret[key] = e
+			}
+			e.Count += c.Count
+			e.Error += c.Error
+		}
+	}
+	for _, s := range sketches {
+		min := s.min()
+		if min == 0 {
+			continue
+		}
+		for key, e := range ret {
+			if _, ok := s.counters[key]; !ok {
+				e.Count += min
+				e.Error += min
+			}
+		}
+	}
+	return ret
+}
+
+func topN(entries map[string]*Entry, n int) []Entry {
+	ret := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, *e)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Key < ret[j].Key
+	})
+	if n > 0 && len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
@@ -0,0 +1,284 @@
+// Package autoban denies clients locally once the detector has blocked
+// them too often. A Banner is both an event.Sink, counting the blocked
+// verdicts of each RemoteAddr, and a t1k.RequestFilter, blocking banned
+// addresses without a detector round trip.
+package autoban
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/event"
+	"github.com/chaitin/t1k-go/iplist"
+)
+
+const (
+	DEFAULT_THRESHOLD    = 50
+	DEFAULT_WINDOW       = time.Minute
+	DEFAULT_BAN_DURATION = 10 * time.Minute
+	DEFAULT_MAX_DURATION = 24 * time.Hour
+	DEFAULT_MEMORY       = 24 * time.Hour
+	DEFAULT_MAX_TRACKED  = 100000
+)
+
+type Config struct {
+	Threshold      int           // blocked verdicts within Window to get banned
+	Window         time.Duration // default 1 minute
+	BanDuration    time.Duration // of a first ban, doubled on each new ban
+	MaxDuration    time.Duration // ban durations stop growing there
+	Memory         time.Duration // offences older than that are forgotten
+	MaxTracked     int           // addresses counted at once, bounds memory
+	Allow          []string      // addresses or CIDRs never banned
+	DenyStatusCode int           // default 403
+}
+
+// Ban is a banned address. Offences counts the bans within Memory,
+// including this one.
+type Ban struct {
+	IP       string    `json:"ip"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+	Offences int       `json:"offences"`
+}
+
+type counter struct {
+	start time.Time
+	count int
+}
+
+type record struct {
+	offences int
+	lastBan  time.Time
+}
+
+type Banner struct {
+	config *Config
+	allow  *iplist.List
+
+	lock     sync.Mutex
+	counters map[string]*counter
+	bans     map[string]*Ban
+	history  map[string]*record
+	now      func() time.Time
+}
+
+func New(config *Config) (*Banner, error) {
+	c := *config
+	if c.Threshold <= 0 {
+		c.Threshold = DEFAULT_THRESHOLD
+	}
+	if c.Window <= 0 {
+		c.Window = DEFAULT_WINDOW
+	}
+	if c.BanDuration <= 0 {
+		c.BanDuration = DEFAULT_BAN_DURATION
+	}
+	if c.MaxDuration <= 0 {
+		c.MaxDuration = DEFAULT_MAX_DURATION
+	}
+	if c.Memory <= 0 {
+		c.Memory = DEFAULT_MEMORY
+	}
+	if c.MaxTracked <= 0 {
+		c.MaxTracked = DEFAULT_MAX_TRACKED
+	}
+	if c.DenyStatusCode == 0 {
+		c.DenyStatusCode = http.StatusForbidden
+	}
+	ret := &Banner{
+		config:   &c,
+		allow:    iplist.New(),
+		counters: make(map[string]*counter),
+		bans:     make(map[string]*Ban),
+		history:  make(map[string]*record),
+		now:      time.Now,
+	}
+	err := ret.UpdateAllowlist(c.Allow)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// UpdateAllowlist replaces the allowlist, current bans of newly allowed
+// addresses are lifted on their next request.
+func (b *Banner) UpdateAllowlist(allow []string) error {
+	return b.allow.Update(allow, nil)
+}
+
+func normalize(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func (b *Banner) allowed(ip string) bool {
+	return b.allow.Lookup(ip) == iplist.ACTION_ALLOW
+}
+
+// sweep removes expired state, it is called with lock held once the
+// counters are full.
+func (b *Banner) sweep(now time.Time) {
+	for ip, c := range b.counters {
+		if now.Sub(c.start) >= b.config.Window {
+			delete(b.counters, ip)
+		}
+	}
+	for ip, ban := range b.bans {
+		if !now.Before(ban.Until) {
+			delete(b.bans, ip)
+		}
+	}
+	for ip, r := range b.history {
+		if now.Sub(r.lastBan) >= b.config.Memory {
+			delete(b.history, ip)
+		}
+	}
+}
+
+func (b *Banner) duration(offences int) time.Duration {
+	d := b.config.BanDuration
+	for i := 1; i < offences && d < b.config.MaxDuration; i++ {
+		d *= 2
+	}
+	if d > b.config.MaxDuration {
+		d = b.config.MaxDuration
+	}
+	return d
+}
+
+func (b *Banner) ban(ip string, now time.Time) {
+	r, ok := b.history[ip]
+	if !ok || now.Sub(r.lastBan) >= b.config.Memory {
+		r = &record{}
+		b.history[ip] = r
+	}
+	r.offences++
+	r.lastBan = now
+	b.bans[ip] = &Ban{
+		IP:       ip,
+		Since:    now,
+		Until:    now.Add(b.duration(r.offences)),
+		Offences: r.offences,
+	}
+}
+
+func (b *Banner) OnlyBlocked() bool {
+	return true
+}
+
+// Emit counts the block verdicts of the detector, challenges, errors and
+// local results are ignored.
+func (b *Banner) Emit(e *event.Event) {
+	if e.Result == nil || e.Result.Verdict() != detection.VERDICT_BLOCK || e.Result.IsLocal() {
+		return
+	}
+	ip := normalize(e.RemoteAddr)
+	if ip == "" || b.allowed(ip) {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.now()
+	if ban, ok := b.bans[ip]; ok && now.Before(ban.Until) {
+		return
+	}
+	c, ok := b.counters[ip]
+	if !ok {
+		if len(b.counters) >= b.config.MaxTracked {
+			b.sweep(now)
+			if len(b.counters) >= b.config.MaxTracked {
+				return
+			}
+		}
+		c = &counter{start: now}
+		b.counters[ip] = c
+	}
+	if now.Sub(c.start) >= b.config.Window {
+		c.start = now
+		c.count = 0
+	}
+	c.count++
+	if c.count >= b.config.Threshold {
+		delete(b.counters, ip)
+		b.ban(ip, now)
+	}
+}
+
+// Lookup returns the ban of addr, nil when it is not banned.
+func (b *Banner) Lookup(addr string) *Ban {
+	ip := normalize(addr)
+	if ip == "" {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ban, ok := b.bans[ip]
+	if !ok {
+		return nil
+	}
+	if !b.now().Before(ban.Until) || b.allowed(ip) {
+		delete(b.bans, ip)
+		return nil
+	}
+	ret := *ban
+	return &ret
+}
+
+// FilterRequest implements t1k.RequestFilter.
+func (b *Banner) FilterRequest(dc *detection.DetectionContext) *detection.Result {
+	if b.Lookup(dc.RemoteAddr) == nil {
+		return nil
+	}
+	return detection.MakeLocalResult(detection.ORIGIN_AUTO_BAN, false, b.config.DenyStatusCode)
+}
+
+// Bans lists the current bans, the longest lasting first.
+func (b *Banner) Bans() []Ban {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.now()
+	ret := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			ret = append(ret, *ban)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Until.After(ret[j].Until)
+	})
+	return ret
+}
+
+// Lift removes the ban of addr and returns whether there was one. The
+// offence stays remembered, a new ban still lasts longer.
+func (b *Banner) Lift(addr string) bool {
+	ip := normalize(addr)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, ok := b.bans[ip]
+	delete(b.bans, ip)
+	delete(b.counters, ip)
+	return ok
+}
+
+// Forget lifts the ban of addr and forgets its past offences.
+func (b *Banner) Forget(addr string) {
+	ip := normalize(addr)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.bans, ip)
+	delete(b.counters, ip)
+	delete(b.history, ip)
+}
@@ -0,0 +1,94 @@
+package autoban
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/event"
+)
+
+func blocked(addr string) *event.Event {
+	e := event.New(nil, detection.MakeLocalResult(detection.ORIGIN_DETECTOR, false, 403))
+	e.RemoteAddr = addr
+	return e
+}
+
+func TestBanEscalation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b, err := New(&Config{Threshold: 3, BanDuration: time.Minute, MaxDuration: 3 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.now = func() time.Time { return now }
+	dc := &detection.DetectionContext{RemoteAddr: "192.0.2.1"}
+
+	for round, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		for i := 0; i < 3; i++ {
+			if b.FilterRequest(dc) != nil {
+				t.Fatalf("round %d: banned after %d blocks", round, i)
+			}
+			b.Emit(blocked("192.0.2.1"))
+		}
+		ret := b.FilterRequest(dc)
+		if ret == nil || ret.Passed() || ret.Origin != detection.ORIGIN_AUTO_BAN || ret.StatusCode() != 403 {
+			t.Fatalf("round %d: not banned: %+v", round, ret)
+		}
+		bans := b.Bans()
+		if len(bans) != 1 || bans[0].Until.Sub(bans[0].Since) != want || bans[0].Offences != round+1 {
+			t.Fatalf("round %d: unexpected bans %+v", round, bans)
+		}
+		now = now.Add(want)
+	}
+	if b.FilterRequest(dc) != nil {
+		t.Fatal("ban not expired")
+	}
+}
+
+func TestBanWindowAndLift(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b, err := New(&Config{Threshold: 2, Window: time.Minute, Allow: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.now = func() time.Time { return now }
+
+	b.Emit(blocked("192.0.2.1"))
+	now = now.Add(time.Minute)
+	b.Emit(blocked("192.0.2.1"))
+	if b.Lookup("192.0.2.1") != nil {
+		t.Fatal("blocks of different windows counted together")
+	}
+	b.Emit(blocked("192.0.2.1"))
+	if b.Lookup("192.0.2.1:1234") == nil {
+		t.Fatal("not banned")
+	}
+	if !b.Lift("192.0.2.1") || b.Lookup("192.0.2.1") != nil || b.Lift("192.0.2.1") {
+		t.Fatal("ban not lifted")
+	}
+
+	for i := 0; i < 5; i++ {
+		b.Emit(blocked("10.1.2.3"))
+	}
+	if b.Lookup("10.1.2.3") != nil {
+		t.Fatal("allowlisted address banned")
+	}
+
+	// local results, like those of the ban itself, are not counted
+	local := event.New(nil, detection.MakeLocalResult(detection.ORIGIN_AUTO_BAN, false, 403))
+	local.RemoteAddr = "192.0.2.9"
+	b.Emit(local)
+	b.Emit(local)
+	if b.Lookup("192.0.2.9") != nil {
+		t.Fatal("local results counted")
+	}
+
+	// bot challenges are not blocks
+	challenge := blocked("192.0.2.10")
+	challenge.Result.BotBody = []byte("<html>prove you are human</html>")
+	b.Emit(challenge)
+	b.Emit(challenge)
+	if b.Lookup("192.0.2.10") != nil {
+		t.Fatal("challenges counted")
+	}
+}
@@ -0,0 +1,358 @@
+// Package capture records request headers exactly as they arrive on the
+// wire, so that the detector sees the original request line and header
+// block instead of what net/http makes of them: header order, case,
+// duplicates and percent-encoding are kept.
+//
+// Capturing is opt-in. Wrap the listener the http.Server reads plain
+// HTTP/1.x from and set its ConnContext:
+//
+//	server := &http.Server{Handler: h, ConnContext: capture.ConnContext}
+//	server.Serve(capture.NewListener(l))
+//
+// then call Apply in t1khttp.Options.PrepareContext. TLS must be
+// terminated below the capture listener, connections whose bytes can not
+// be followed, like HTTP/2 or upgraded ones, fall back to re-serializing.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+const (
+	DEFAULT_MAX_HEADER_BYTES = http.DefaultMaxHeaderBytes + 4096
+	DEFAULT_MAX_PENDING      = 8
+)
+
+type Listener struct {
+	net.Listener
+	// header blocks larger than that stop capturing on the connection
+	MaxHeaderBytes int
+	// header blocks read ahead of their handler, the oldest are dropped
+	MaxPending int
+}
+
+func NewListener(l net.Listener) *Listener {
+	return &Listener{
+		Listener:       l,
+		MaxHeaderBytes: DEFAULT_MAX_HEADER_BYTES,
+		MaxPending:     DEFAULT_MAX_PENDING,
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ret := &Conn{
+		Conn: c,
+		parser: parser{
+			maxHeaderBytes: l.MaxHeaderBytes,
+			maxPending:     l.MaxPending,
+		},
+	}
+	if ret.parser.maxHeaderBytes <= 0 {
+		ret.parser.maxHeaderBytes = DEFAULT_MAX_HEADER_BYTES
+	}
+	if ret.parser.maxPending <= 0 {
+		ret.parser.maxPending = DEFAULT_MAX_PENDING
+	}
+	return ret, nil
+}
+
+// Conn follows the HTTP/1.x messages read from it and keeps the header
+// blocks until their handler takes them.
+type Conn struct {
+	net.Conn
+
+	lock   sync.Mutex
+	parser parser
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.lock.Lock()
+		c.parser.feed(p[:n])
+		c.lock.Unlock()
+	}
+	return n, err
+}
+
+// take returns the oldest header block parsing to r, dropping older ones
+// whose handlers never took them, nil when it was dropped or not captured.
+func (c *Conn) take(r *http.Request) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, header := range c.parser.pending {
+		if matches(header, r) {
+			c.parser.pending = c.parser.pending[i+1:]
+			return header
+		}
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// ConnContext is meant for http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if cc, ok := c.(*Conn); ok {
+		return context.WithValue(ctx, contextKey{}, cc)
+	}
+	return ctx
+}
+
+// Header returns the header block of r as received, nil when it was not
+// captured or does not parse to the request line and header fields of r.
+// It must be called once per request, handlers which do not call it leave
+// their header block to be dropped by the next request taking one.
+func Header(r *http.Request) []byte {
+	c, ok := r.Context().Value(contextKey{}).(*Conn)
+	if !ok {
+		return nil
+	}
+	return c.take(r)
+}
+
+// matches tells whether header parses to the request r was read from, as
+// net/http does, which drops Host from the header fields.
+func matches(header []byte, r *http.Request) bool {
+	parsed, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return false
+	}
+	delete(parsed.Header, "Host")
+	return parsed.Method == r.Method &&
+		parsed.RequestURI == r.RequestURI &&
+		parsed.Proto == r.Proto &&
+		parsed.Host == r.Host &&
+		reflect.DeepEqual(parsed.Header, r.Header)
+}
+
+// Apply makes the HttpRequest of dc send its captured header block, it
+// does nothing when there is none.
+func Apply(dc *detection.DetectionContext) {
+	req, ok := dc.Request.(*detection.HttpRequest)
+	if !ok {
+		return
+	}
+	if header := Header(req.HttpRequest()); header != nil {
+		req.UseRawHeader(header)
+	}
+}
+
+// requestLine returns the method and protocol of header.
+func requestLine(header []byte) (string, string) {
+	line := header
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 {
+		return "", ""
+	}
+	return fields[0], fields[2]
+}
+
+type state int
+
+const (
+	stateHeader state = iota
+	stateBody
+	stateChunkSize
+	stateChunkData
+	stateChunkDataEnd
+	stateTrailer
+	stateStopped
+)
+
+// parser splits a stream of HTTP/1.x requests into header blocks,
+// skipping bodies by Content-Length or chunked framing.
+type parser struct {
+	maxHeaderBytes int
+	maxPending     int
+
+	state   state
+	buf     []byte // header block or current line
+	remain  int64
+	pending [][]byte
+}
+
+func (p *parser) stop() {
+	p.state = stateStopped
+	p.buf = nil
+}
+
+// readLine appends b up to a newline to buf, it returns the rest of b and
+// whether the line is complete.
+func (p *parser) readLine(b []byte) ([]byte, bool) {
+	i := bytes.IndexByte(b, '\n')
+	rest, done := b[i+1:], true
+	if i < 0 {
+		i, rest, done = len(b)-1, nil, false
+	}
+	p.buf = append(p.buf, b[:i+1]...)
+	if len(p.buf) > p.maxHeaderBytes {
+		p.stop()
+		return nil, false
+	}
+	return rest, done
+}
+
+func (p *parser) feed(b []byte) {
+	for len(b) > 0 {
+		switch p.state {
+		case stateStopped:
+			return
+		case stateHeader:
+			if len(p.buf) == 0 {
+				// empty lines between requests are ignored
+				for len(b) > 0 && (b[0] == '\r' || b[0] == '\n') {
+					b = b[1:]
+				}
+				if len(b) == 0 {
+					return
+				}
+			}
+			var done bool
+			b, done = p.readLine(b)
+			if done && (bytes.HasSuffix(p.buf, []byte("\n\r\n")) || bytes.HasSuffix(p.buf, []byte("\n\n"))) {
+				p.endHeader()
+			}
+		case stateBody:
+			n := int64(len(b))
+			if n > p.remain {
+				n = p.remain
+			}
+			b = b[n:]
+			p.remain -= n
+			if p.remain == 0 {
+				p.state = stateHeader
+			}
+		case stateChunkSize:
+			var done bool
+			b, done = p.readLine(b)
+			if !done {
+				continue
+			}
+			line := strings.TrimSpace(string(p.buf))
+			p.buf = p.buf[:0]
+			if i := strings.IndexByte(line, ';'); i >= 0 {
+				line = strings.TrimSpace(line[:i])
+			}
+			size, err := strconv.ParseInt(line, 16, 64)
+			if err != nil || size < 0 {
+				p.stop()
+				return
+			}
+			if size == 0 {
+				p.state = stateTrailer
+			} else {
+				p.remain = size
+				p.state = stateChunkData
+			}
+		case stateChunkData:
+			n := int64(len(b))
+			if n > p.remain {
+				n = p.remain
+			}
+			b = b[n:]
+			p.remain -= n
+			if p.remain == 0 {
+				p.state = stateChunkDataEnd
+			}
+		case stateChunkDataEnd:
+			var done bool
+			b, done = p.readLine(b)
+			if done {
+				p.buf = p.buf[:0]
+				p.state = stateChunkSize
+			}
+		case stateTrailer:
+			var done bool
+			b, done = p.readLine(b)
+			if !done {
+				continue
+			}
+			empty := len(bytes.TrimSpace(p.buf)) == 0
+			p.buf = p.buf[:0]
+			if empty {
+				p.state = stateHeader
+			}
+		}
+	}
+}
+
+// endHeader queues the header block in buf and skips the body it frames
+// the way net/http does, stopping on framing net/http may read otherwise.
+func (p *parser) endHeader() {
+	header := p.buf
+	p.buf = nil
+	p.pending = append(p.pending, header)
+	if len(p.pending) > p.maxPending {
+		p.pending = p.pending[1:]
+	}
+
+	method, proto := requestLine(header)
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok || major != 1 {
+		p.stop()
+		return
+	}
+	var encodings []string
+	var upgrade bool
+	length := int64(-1)
+	lines := strings.Split(string(header), "\n")
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.ToLower(strings.TrimSpace(line[i+1:]))
+		switch name {
+		case "transfer-encoding":
+			encodings = append(encodings, value)
+		case "content-length":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 || (length >= 0 && n != length) {
+				// net/http rejects it as well
+				p.stop()
+				return
+			}
+			length = n
+		case "upgrade":
+			upgrade = true
+		}
+	}
+	// HTTP/1.0 ignores Transfer-Encoding, HTTP/1.1 only knows a single
+	// chunked one, which smuggling attempts pair with Content-Length
+	chunked := minor >= 1 && len(encodings) > 0
+	if chunked && (len(encodings) != 1 || encodings[0] != "chunked" || length >= 0) {
+		p.stop()
+		return
+	}
+	switch {
+	case method == http.MethodConnect || upgrade:
+		// the connection may switch to another protocol
+		p.stop()
+	case chunked:
+		p.state = stateChunkSize
+	case length > 0:
+		p.remain = length
+		p.state = stateBody
+	default:
+		p.state = stateHeader
+	}
+}
@@ -0,0 +1,201 @@
+package capture
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+func TestParserKeepAlive(t *testing.T) {
+	first := "POST /a%2fb?x=%41 HTTP/1.1\r\nhost: a\r\nHost: b\r\nTransfer-Encoding: chunked\r\nx-B: 1\r\n\r\n"
+	second := "GET /c HTTP/1.1\nHost: a\n\n"
+	stream := first + "3;ext=1\r\nabc\r\n0\r\nTrailer: x\r\n\r\n" + "\r\n" + second + "POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nGET "
+	p := parser{maxHeaderBytes: DEFAULT_MAX_HEADER_BYTES, maxPending: DEFAULT_MAX_PENDING}
+	// byte by byte, as reads may split anywhere
+	for i := 0; i < len(stream); i++ {
+		p.feed([]byte{stream[i]})
+	}
+	if len(p.pending) != 3 {
+		t.Fatalf("got %d header blocks", len(p.pending))
+	}
+	if string(p.pending[0]) != first || string(p.pending[1]) != second {
+		t.Fatalf("got %q", p.pending[:2])
+	}
+	if p.state != stateHeader {
+		t.Fatalf("body not skipped, state %d", p.state)
+	}
+}
+
+func TestParserStops(t *testing.T) {
+	p := parser{maxHeaderBytes: 16, maxPending: DEFAULT_MAX_PENDING}
+	p.feed([]byte("GET /a-very-long-target HTTP/1.1\r\n"))
+	if p.state != stateStopped || len(p.pending) != 0 {
+		t.Fatal("oversized header not stopped")
+	}
+	p = parser{maxHeaderBytes: DEFAULT_MAX_HEADER_BYTES, maxPending: DEFAULT_MAX_PENDING}
+	p.feed([]byte("GET /ws HTTP/1.1\r\nUpgrade: websocket\r\n\r\nGET / HTTP/1.1\r\n\r\n"))
+	if p.state != stateStopped || len(p.pending) != 1 {
+		t.Fatal("upgraded connection still parsed")
+	}
+}
+
+func TestParserFraming(t *testing.T) {
+	// HTTP/1.0 ignores Transfer-Encoding, the body is framed by length
+	p := parser{maxHeaderBytes: DEFAULT_MAX_HEADER_BYTES, maxPending: DEFAULT_MAX_PENDING}
+	p.feed([]byte("POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n"))
+	if p.state != stateHeader || len(p.pending) != 1 {
+		t.Fatalf("HTTP/1.0 body not skipped by length, state %d", p.state)
+	}
+	for _, header := range []string{
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\n",
+		"POST / HTTP/2.0\r\n\r\n",
+	} {
+		p = parser{maxHeaderBytes: DEFAULT_MAX_HEADER_BYTES, maxPending: DEFAULT_MAX_PENDING}
+		p.feed([]byte(header))
+		if p.state != stateStopped {
+			t.Fatalf("ambiguous framing not stopped: %q", header)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := make(chan []byte, 2)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dc, err := detection.MakeContextWithRequest(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			Apply(dc)
+			header, _ := dc.Request.Header()
+			headers <- header
+			io.Copy(io.Discard, r.Body)
+		}),
+		ConnContext: ConnContext,
+	}
+	go server.Serve(NewListener(l))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	first := "POST /a/%2e%2E/b?q=%3Cx%3e HTTP/1.1\r\nhost: example.com\r\nX-Order: 2\r\nx-order: 1\r\nContent-Length: 5\r\n\r\n"
+	second := "GET /next HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n"
+	_, err = conn.Write([]byte(first + "hello" + second + "2\r\nhi\r\n0\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	for _, want := range []string{first, second} {
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if got := string(<-headers); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestServerSmuggledHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := make(chan []byte, 2)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			dc, err := detection.MakeContextWithRequest(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			Apply(dc)
+			header, _ := dc.Request.Header()
+			headers <- header
+		}),
+		ConnContext: ConnContext,
+	}
+	go server.Serve(NewListener(l))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a chunked reader would see a fake request in the body
+	body := "0\r\n\r\nGET /admin HTTP/1.1\r\nHost: a\r\nX-Benign: 1\r\n\r\n"
+	first := "POST / HTTP/1.0\r\nHost: a\r\nConnection: keep-alive\r\nTransfer-Encoding: chunked\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"
+	second := "GET /admin HTTP/1.1\r\nHost: a\r\nX-Attack: 1\r\n\r\n"
+	_, err = conn.Write([]byte(first + body + second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	for _, want := range []string{first, second} {
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if got := string(<-headers); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestHeaderMismatch(t *testing.T) {
+	c := &Conn{parser: parser{maxHeaderBytes: DEFAULT_MAX_HEADER_BYTES, maxPending: DEFAULT_MAX_PENDING}}
+	c.parser.feed([]byte("GET /admin HTTP/1.1\r\nHost: a\r\nX-Benign: 1\r\n\r\n"))
+	r := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	r.Host = "a"
+	r.Header.Set("X-Attack", "1")
+	r = r.WithContext(context.WithValue(r.Context(), contextKey{}, c))
+	if header := Header(r); header != nil {
+		t.Fatalf("header of another request returned: %q", header)
+	}
+}
+
+func TestHeaderSkippedByHandler(t *testing.T) {
+	c := &Conn{parser: parser{maxHeaderBytes: DEFAULT_MAX_HEADER_BYTES, maxPending: DEFAULT_MAX_PENDING}}
+	// the handler of /stats never takes its header block
+	stats := "GET /stats HTTP/1.1\r\nHost: a\r\n\r\n"
+	first := "GET /a HTTP/1.1\r\nHost: a\r\nX-Order: 1\r\n\r\n"
+	second := "GET /b HTTP/1.1\r\nHost: a\r\n\r\n"
+	c.parser.feed([]byte(stats + first + second))
+	for _, want := range []string{first, second} {
+		r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(want)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, c))
+		if got := string(Header(r)); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if len(c.parser.pending) != 0 {
+		t.Fatalf("%d header blocks left", len(c.parser.pending))
+	}
+}
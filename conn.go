@@ -1,6 +1,7 @@
 package t1k
 
 import (
+	"errors"
 	"net"
 	"net/http"
 
@@ -51,6 +52,60 @@ func (c *conn) onErr(err error) {
 	}
 }
 
+// connError marks the errors of the connection to the detector, as opposed
+// to errors reading the message to send or decoding the detector answer.
+type connError struct {
+	err error
+}
+
+func (e *connError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connError) Unwrap() error {
+	return e.err
+}
+
+// IsConnError tells whether err comes from reaching the detector, getting
+// a connection or reading and writing its socket, so that the same message
+// may succeed once the detector is reachable again.
+func IsConnError(err error) bool {
+	var ce *connError
+	return errors.As(err, &ce)
+}
+
+// socketIO records whether reading or writing the socket failed.
+type socketIO struct {
+	socket net.Conn
+	failed bool
+}
+
+func (s *socketIO) Read(b []byte) (int, error) {
+	n, err := s.socket.Read(b)
+	if err != nil {
+		s.failed = true
+	}
+	return n, err
+}
+
+func (s *socketIO) Write(b []byte) (int, error) {
+	n, err := s.socket.Write(b)
+	if err != nil {
+		s.failed = true
+	}
+	return n, err
+}
+
+// done recovers the connection after err and marks it as a connError when
+// the socket failed.
+func (c *conn) done(sock *socketIO, err error) error {
+	c.onErr(err)
+	if err != nil && sock.failed {
+		return &connError{err: err}
+	}
+	return err
+}
+
 func (c *conn) Close() {
 	if !c.failing {
 		c.socket.Close()
@@ -59,33 +114,33 @@ func (c *conn) Close() {
 }
 
 func (c *conn) DetectRequestInCtx(dc *detection.DetectionContext) (*detection.Result, error) {
-	ret, err := DetectRequestInCtx(c.socket, dc)
-	c.onErr(err)
-	return ret, err
+	sock := &socketIO{socket: c.socket}
+	ret, err := detectRequestInCtx(sock, dc, c.server.resultDecoder())
+	return ret, c.done(sock, err)
 }
 
 func (c *conn) DetectResponseInCtx(dc *detection.DetectionContext) (*detection.Result, error) {
-	ret, err := DetectResponseInCtx(c.socket, dc)
-	c.onErr(err)
-	return ret, misc.ErrorWrap(err, "")
+	sock := &socketIO{socket: c.socket}
+	ret, err := detectResponseInCtx(sock, dc, c.server.resultDecoder())
+	return ret, misc.ErrorWrap(c.done(sock, err), "")
 }
 
 func (c *conn) Detect(dc *detection.DetectionContext) (*detection.Result, *detection.Result, error) {
-	retReq, retRsp, err := Detect(c.socket, dc)
-	c.onErr(err)
-	return retReq, retRsp, misc.ErrorWrap(err, "")
+	sock := &socketIO{socket: c.socket}
+	retReq, retRsp, err := detect(sock, dc, c.server.resultDecoder())
+	return retReq, retRsp, misc.ErrorWrap(c.done(sock, err), "")
 }
 
 func (c *conn) DetectHttpRequest(req *http.Request) (*detection.Result, error) {
-	ret, err := DetectHttpRequest(c.socket, req)
-	c.onErr(err)
-	return ret, err
+	sock := &socketIO{socket: c.socket}
+	ret, err := detectHttpRequest(sock, req, c.server.resultDecoder())
+	return ret, c.done(sock, err)
 }
 
 func (c *conn) DetectRequest(req detection.Request) (*detection.Result, error) {
-	ret, err := DetectRequest(c.socket, req)
-	c.onErr(err)
-	return ret, err
+	sock := &socketIO{socket: c.socket}
+	ret, err := doDetectRequest(sock, req, c.server.resultDecoder())
+	return ret, c.done(sock, err)
 }
 
 func (c *conn) Heartbeat() {
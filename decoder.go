@@ -0,0 +1,195 @@
+package t1k
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/t1k"
+
+	"github.com/chaitin/t1k-go/misc"
+)
+
+// SectionHandler decodes the body of a result section into ret. body
+// streams the section and is only valid during the call; whatever the
+// handler leaves unread is discarded.
+type SectionHandler func(ret *detection.Result, tag t1k.Tag, body io.Reader) error
+
+// ResultDecoder reads detection results, dispatching each section to the
+// handler registered for its tag. Sections without a handler are kept in
+// Result.Sections unless DropUnknownSections is set. The zero value has
+// the built-in handlers, like NewResultDecoder.
+type ResultDecoder struct {
+	// nil until a handler is registered, builtinHandlers are used then
+	handlers            map[t1k.Tag]SectionHandler
+	DropUnknownSections bool
+}
+
+var defaultResultDecoder = NewResultDecoder()
+
+func bytesHandler(field func(ret *detection.Result) *[]byte) SectionHandler {
+	return func(ret *detection.Result, tag t1k.Tag, body io.Reader) error {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		*field(ret) = data
+		return nil
+	}
+}
+
+func handleHead(ret *detection.Result, tag t1k.Tag, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if len(data) != 1 {
+		return fmt.Errorf("len(T1K_HEADER) != 1")
+	}
+	ret.Head = data[0]
+	return nil
+}
+
+// builtinHandlers handle all the sections known to Result, they are
+// never modified.
+var builtinHandlers = map[t1k.Tag]SectionHandler{
+	t1k.TAG_HEADER:       handleHead,
+	t1k.TAG_BODY:         bytesHandler(func(ret *detection.Result) *[]byte { return &ret.Body }),
+	t1k.TAG_ALOG:         bytesHandler(func(ret *detection.Result) *[]byte { return &ret.Alog }),
+	t1k.TAG_EXTRA_HEADER: bytesHandler(func(ret *detection.Result) *[]byte { return &ret.ExtraHeader }),
+	t1k.TAG_EXTRA_BODY:   bytesHandler(func(ret *detection.Result) *[]byte { return &ret.ExtraBody }),
+	t1k.TAG_CONTEXT:      bytesHandler(func(ret *detection.Result) *[]byte { return &ret.T1KContext }),
+	t1k.TAG_COOKIE:       bytesHandler(func(ret *detection.Result) *[]byte { return &ret.Cookie }),
+	t1k.TAG_WEB_LOG:      bytesHandler(func(ret *detection.Result) *[]byte { return &ret.WebLog }),
+	t1k.TAG_BOT_QUERY:    bytesHandler(func(ret *detection.Result) *[]byte { return &ret.BotQuery }),
+	t1k.TAG_BOT_BODY:     bytesHandler(func(ret *detection.Result) *[]byte { return &ret.BotBody }),
+	t1k.TAG_USER_DATA:    bytesHandler(func(ret *detection.Result) *[]byte { return &ret.UserData }),
+}
+
+// NewResultDecoder returns a decoder with handlers for all the sections
+// known to Result.
+func NewResultDecoder() *ResultDecoder {
+	return &ResultDecoder{}
+}
+
+func copyHandlers(handlers map[t1k.Tag]SectionHandler) map[t1k.Tag]SectionHandler {
+	ret := make(map[t1k.Tag]SectionHandler, len(handlers))
+	for tag, h := range handlers {
+		ret[tag] = h
+	}
+	return ret
+}
+
+func (d *ResultDecoder) clone() *ResultDecoder {
+	ret := &ResultDecoder{
+		DropUnknownSections: d.DropUnknownSections,
+	}
+	if d.handlers != nil {
+		ret.handlers = copyHandlers(d.handlers)
+	}
+	return ret
+}
+
+func (d *ResultDecoder) handler(tag t1k.Tag) (SectionHandler, bool) {
+	if d.handlers == nil {
+		h, ok := builtinHandlers[tag]
+		return h, ok
+	}
+	h, ok := d.handlers[tag]
+	return h, ok
+}
+
+// RegisterSectionHandler sets the handler of tag, replacing the built-in
+// one if any. A nil handler removes it. It must not be called while d is
+// decoding.
+func (d *ResultDecoder) RegisterSectionHandler(tag t1k.Tag, h SectionHandler) {
+	tag = tag.Strip()
+	if d.handlers == nil {
+		d.handlers = copyHandlers(builtinHandlers)
+	}
+	if h == nil {
+		delete(d.handlers, tag)
+		return
+	}
+	d.handlers[tag] = h
+}
+
+func (d *ResultDecoder) parseSection(ret *detection.Result, sec *t1k.SplitSection) error {
+	tag := sec.Tag().Strip()
+	h, ok := d.handler(tag)
+	if !ok {
+		if d.DropUnknownSections {
+			_, err := io.Copy(io.Discard, sec)
+			return misc.ErrorWrap(err, "")
+		}
+		var buf bytes.Buffer
+		err := sec.WriteBody(&buf)
+		if err != nil {
+			return err
+		}
+		if ret.Sections == nil {
+			ret.Sections = make(map[t1k.Tag][]byte)
+		}
+		ret.Sections[tag] = buf.Bytes()
+		return nil
+	}
+	err := h(ret, tag, sec)
+	if err != nil {
+		return misc.ErrorWrapf(err, "handle section <%x>", tag)
+	}
+	_, err = io.Copy(io.Discard, sec)
+	return misc.ErrorWrap(err, "")
+}
+
+// Decode reads one detection result from r.
+func (d *ResultDecoder) Decode(r io.Reader) (*detection.Result, error) {
+	var ret detection.Result
+	sec, err := t1k.ReadSplitSection(r)
+	if err != nil {
+		return nil, misc.ErrorWrap(err, "")
+	}
+	if !sec.Tag().IsFirst() {
+		return nil, fmt.Errorf("first section IsFirst != true, middle of another msg or corrupt stream, with <%x>", sec.Tag())
+	}
+	for {
+		err = d.parseSection(&ret, sec)
+		if err != nil {
+			return nil, misc.ErrorWrap(err, "")
+		}
+		if sec.Tag().IsLast() {
+			break
+		}
+		sec, err = t1k.ReadSplitSection(r)
+		if err != nil {
+			return nil, misc.ErrorWrap(err, "")
+		}
+	}
+	ret.Prepare()
+	return &ret, nil
+}
+
+func (s *Server) resultDecoder() *ResultDecoder {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.decoder
+}
+
+// RegisterSectionHandler sets the handler of tag for results read by s,
+// see ResultDecoder.RegisterSectionHandler. It is safe to call while s is
+// detecting.
+func (s *Server) RegisterSectionHandler(tag t1k.Tag, h SectionHandler) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	d := s.decoder.clone()
+	d.RegisterSectionHandler(tag, h)
+	s.decoder = d
+}
+
+// UpdateResultDecoder replaces the decoder of results read by s. d must
+// not be modified afterwards.
+func (s *Server) UpdateResultDecoder(d *ResultDecoder) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.decoder = d
+}
@@ -0,0 +1,98 @@
+package t1k
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/t1k"
+)
+
+func makeResultStream(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	sections := []t1k.Section{
+		t1k.MakeSimpleSection(t1k.TAG_HEADER|t1k.MASK_FIRST, []byte("?")),
+		t1k.MakeSimpleSection(t1k.TAG_BODY, []byte("403")),
+		t1k.MakeSimpleSection(t1k.TAG_STAT, []byte("cpu:3")),
+		t1k.MakeSimpleSection(0x3e|t1k.MASK_LAST, []byte("future")),
+	}
+	for _, sec := range sections {
+		if err := t1k.WriteSection(sec, &buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+func TestDecoderKeepsUnknownSections(t *testing.T) {
+	ret, err := NewResultDecoder().Decode(makeResultStream(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Head != '?' || string(ret.Body) != "403" {
+		t.Fatalf("unexpected result %+v", ret)
+	}
+	if string(ret.Sections[t1k.TAG_STAT]) != "cpu:3" || string(ret.Sections[0x3e]) != "future" {
+		t.Fatalf("unknown sections not kept: %q", ret.Sections)
+	}
+
+	d := NewResultDecoder()
+	d.DropUnknownSections = true
+	ret, err = d.Decode(makeResultStream(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Sections != nil {
+		t.Fatalf("unknown sections not dropped: %q", ret.Sections)
+	}
+}
+
+func TestDecoderSectionHandler(t *testing.T) {
+	var stat []byte
+	d := NewResultDecoder()
+	d.RegisterSectionHandler(t1k.TAG_STAT, func(ret *detection.Result, tag t1k.Tag, body io.Reader) error {
+		// read only part of the body, the rest must be skipped
+		stat = make([]byte, 3)
+		_, err := io.ReadFull(body, stat)
+		return err
+	})
+	d.RegisterSectionHandler(t1k.TAG_BODY, nil)
+	ret, err := d.Decode(makeResultStream(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stat) != "cpu" {
+		t.Fatalf("unexpected stat %q", stat)
+	}
+	if ret.Body != nil || string(ret.Sections[t1k.TAG_BODY]) != "403" {
+		t.Fatalf("removed handler still used: %+v", ret)
+	}
+	if _, ok := ret.Sections[t1k.TAG_STAT]; ok {
+		t.Fatal("handled section should not be kept")
+	}
+}
+
+func TestDecoderZeroValue(t *testing.T) {
+	var d ResultDecoder
+	ret, err := d.Decode(makeResultStream(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Head != '?' || string(ret.Body) != "403" || !ret.Blocked() {
+		t.Fatalf("built-in handlers not used: %+v", ret)
+	}
+
+	var stat []byte
+	d.RegisterSectionHandler(t1k.TAG_STAT, bytesHandler(func(ret *detection.Result) *[]byte { return &stat }))
+	ret, err = d.Decode(makeResultStream(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stat) != "cpu:3" || string(ret.Body) != "403" {
+		t.Fatalf("unexpected result %+v, stat %q", ret, stat)
+	}
+	if _, ok := builtinHandlers[t1k.TAG_STAT]; ok {
+		t.Fatal("built-in handlers modified")
+	}
+}
@@ -1,8 +1,6 @@
 package t1k
 
 import (
-	"bytes"
-	"fmt"
 	"io"
 	"net/http"
 
@@ -12,6 +10,33 @@ import (
 	"github.com/chaitin/t1k-go/misc"
 )
 
+// writeUserData sends the TAG_USER_DATA section of v, if any.
+func writeUserData(w io.Writer, v interface{}) error {
+	p, ok := v.(detection.UserDataProvider)
+	if !ok {
+		return nil
+	}
+	data, err := p.UserData()
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	sec := t1k.MakeSimpleSection(t1k.TAG_USER_DATA, data)
+	return t1k.WriteSection(sec, w)
+}
+
+// writeBody sends the body of v as sections carrying tag, split when it
+// is 4 GiB or more. A body that cannot be had is skipped.
+func writeBody(w io.Writer, tag t1k.Tag, v interface {
+	Body() (uint32, io.ReadCloser, error)
+}) error {
+	size, bodyReadCloser, err := detection.BodyOf(v)
+	if err != nil {
+		return nil
+	}
+	defer bodyReadCloser.Close()
+	return t1k.WriteSplitSection(tag, size, bodyReadCloser, w)
+}
+
 func writeDetectionRequest(w io.Writer, req detection.Request) error {
 	{
 		data, err := req.Header()
@@ -24,16 +49,9 @@ func writeDetectionRequest(w io.Writer, req detection.Request) error {
 			return err
 		}
 	}
-	{
-		bodySize, bodyReadCloser, err := req.Body()
-		if err == nil {
-			defer bodyReadCloser.Close()
-			sec := t1k.MakeReaderSection(t1k.TAG_BODY, bodySize, bodyReadCloser)
-			err = t1k.WriteSection(sec, w)
-			if err != nil {
-				return err
-			}
-		}
+	err := writeBody(w, t1k.TAG_BODY, req)
+	if err != nil {
+		return err
 	}
 	{
 		data, err := req.Extra()
@@ -46,6 +64,10 @@ func writeDetectionRequest(w io.Writer, req detection.Request) error {
 			return err
 		}
 	}
+	err = writeUserData(w, req)
+	if err != nil {
+		return err
+	}
 	{
 		sec := t1k.MakeSimpleSection(t1k.TAG_VERSION|t1k.MASK_LAST, []byte("Proto:2\n"))
 		err := t1k.WriteSection(sec, w)
@@ -79,16 +101,9 @@ func writeDetectionResponse(w io.Writer, rsp detection.Response) error {
 			return misc.ErrorWrap(err, "")
 		}
 	}
-	{
-		bodySize, bodyReadCloser, err := rsp.Body()
-		if err == nil {
-			defer bodyReadCloser.Close()
-			sec := t1k.MakeReaderSection(t1k.TAG_RSP_BODY, bodySize, bodyReadCloser)
-			err = t1k.WriteSection(sec, w)
-			if err != nil {
-				return err
-			}
-		}
+	err := writeBody(w, t1k.TAG_RSP_BODY, rsp)
+	if err != nil {
+		return err
 	}
 	{
 		data, err := rsp.Extra()
@@ -101,6 +116,10 @@ func writeDetectionResponse(w io.Writer, rsp detection.Response) error {
 			return misc.ErrorWrap(err, "")
 		}
 	}
+	err = writeUserData(w, rsp)
+	if err != nil {
+		return misc.ErrorWrap(err, "")
+	}
 	{
 		sec := t1k.MakeSimpleSection(t1k.TAG_VERSION, []byte("Proto:2\n"))
 		err := t1k.WriteSection(sec, w)
@@ -123,66 +142,15 @@ func writeDetectionResponse(w io.Writer, rsp detection.Response) error {
 }
 
 func readDetectionResult(r io.Reader) (*detection.Result, error) {
-	var ret detection.Result
-	parseSection := func(sec t1k.Section) error {
-		var buf bytes.Buffer
-		err := sec.WriteBody(&buf)
-		if err != nil {
-			return misc.ErrorWrap(err, "")
-		}
-		tag := sec.Header().Tag.Strip()
-		switch tag {
-		case t1k.TAG_HEADER:
-			if len(buf.Bytes()) != 1 {
-				return fmt.Errorf("len(T1K_HEADER) != 1")
-			}
-			ret.Head = buf.Bytes()[0]
-		case t1k.TAG_BODY:
-			ret.Body = buf.Bytes()
-		case t1k.TAG_ALOG:
-			ret.Alog = buf.Bytes()
-		case t1k.TAG_EXTRA_HEADER:
-			ret.ExtraHeader = buf.Bytes()
-		case t1k.TAG_EXTRA_BODY:
-			ret.ExtraBody = buf.Bytes()
-		case t1k.TAG_CONTEXT:
-			ret.T1KContext = buf.Bytes()
-		case t1k.TAG_COOKIE:
-			ret.Cookie = buf.Bytes()
-		case t1k.TAG_WEB_LOG:
-			ret.WebLog = buf.Bytes()
-		}
-		return nil
-	}
-	sec, err := t1k.ReadFullSection(r)
-	if err != nil {
-		return nil, misc.ErrorWrap(err, "")
-	}
-	if !sec.Header().Tag.IsFirst() {
-		return nil, fmt.Errorf("first section IsFirst != true, middle of another msg or corrupt stream, with <%x>", sec.Header().Tag)
-	}
-	for {
-		err = parseSection(sec)
-		if err != nil {
-			return nil, misc.ErrorWrap(err, "")
-		}
-		if sec.Header().Tag.IsLast() {
-			break
-		}
-		sec, err = t1k.ReadSection(r)
-		if err != nil {
-			return nil, misc.ErrorWrap(err, "")
-		}
-	}
-	return &ret, nil
+	return defaultResultDecoder.Decode(r)
 }
 
-func doDetectRequest(s io.ReadWriter, req detection.Request) (*detection.Result, error) {
+func doDetectRequest(s io.ReadWriter, req detection.Request, d *ResultDecoder) (*detection.Result, error) {
 	err := writeDetectionRequest(s, req)
 	if err != nil {
 		return nil, misc.ErrorWrap(err, "")
 	}
-	ret, err := readDetectionResult(s)
+	ret, err := d.Decode(s)
 	if err != nil {
 		return nil, misc.ErrorWrap(err, "")
 	}
@@ -190,12 +158,12 @@ func doDetectRequest(s io.ReadWriter, req detection.Request) (*detection.Result,
 	return ret, nil
 }
 
-func doDetectResponse(s io.ReadWriter, rsp detection.Response) (*detection.Result, error) {
+func doDetectResponse(s io.ReadWriter, rsp detection.Response, d *ResultDecoder) (*detection.Result, error) {
 	err := writeDetectionResponse(s, rsp)
 	if err != nil {
 		return nil, misc.ErrorWrap(err, "")
 	}
-	ret, err := readDetectionResult(s)
+	ret, err := d.Decode(s)
 	if err != nil {
 		return nil, misc.ErrorWrap(err, "")
 	}
@@ -203,8 +171,8 @@ func doDetectResponse(s io.ReadWriter, rsp detection.Response) (*detection.Resul
 	return ret, nil
 }
 
-func DetectRequestInCtx(s io.ReadWriter, dc *detection.DetectionContext) (*detection.Result, error) {
-	ret, err := doDetectRequest(s, dc.Request)
+func detectRequestInCtx(s io.ReadWriter, dc *detection.DetectionContext, d *ResultDecoder) (*detection.Result, error) {
+	ret, err := doDetectRequest(s, dc.Request, d)
 	if err != nil {
 		return nil, err
 	}
@@ -212,8 +180,8 @@ func DetectRequestInCtx(s io.ReadWriter, dc *detection.DetectionContext) (*detec
 	return ret, nil
 }
 
-func DetectResponseInCtx(s io.ReadWriter, dc *detection.DetectionContext) (*detection.Result, error) {
-	ret, err := doDetectResponse(s, dc.Response)
+func detectResponseInCtx(s io.ReadWriter, dc *detection.DetectionContext, d *ResultDecoder) (*detection.Result, error) {
+	ret, err := doDetectResponse(s, dc.Response, d)
 	if err != nil {
 		return nil, misc.ErrorWrap(err, "")
 	}
@@ -221,11 +189,11 @@ func DetectResponseInCtx(s io.ReadWriter, dc *detection.DetectionContext) (*dete
 	return ret, nil
 }
 
-func Detect(s io.ReadWriter, dc *detection.DetectionContext) (*detection.Result, *detection.Result, error) {
+func detect(s io.ReadWriter, dc *detection.DetectionContext, d *ResultDecoder) (*detection.Result, *detection.Result, error) {
 	var reqResult *detection.Result
 	var rspResult *detection.Result
 	if dc.Request != nil {
-		ret, err := doDetectRequest(s, dc.Request)
+		ret, err := doDetectRequest(s, dc.Request, d)
 		if err != nil {
 			return nil, nil, misc.ErrorWrap(err, "")
 		}
@@ -233,7 +201,7 @@ func Detect(s io.ReadWriter, dc *detection.DetectionContext) (*detection.Result,
 		dc.ProcessResult(reqResult)
 	}
 	if dc.Response != nil {
-		ret, err := doDetectResponse(s, dc.Response)
+		ret, err := doDetectResponse(s, dc.Response, d)
 		if err != nil {
 			return nil, nil, misc.ErrorWrap(err, "")
 		}
@@ -243,11 +211,27 @@ func Detect(s io.ReadWriter, dc *detection.DetectionContext) (*detection.Result,
 	return reqResult, rspResult, nil
 }
 
-func DetectHttpRequest(s io.ReadWriter, req *http.Request) (*detection.Result, error) {
+func detectHttpRequest(s io.ReadWriter, req *http.Request, d *ResultDecoder) (*detection.Result, error) {
 	dc, _ := detection.MakeContextWithRequest(req)
-	return doDetectRequest(s, detection.MakeHttpRequestInCtx(req, dc))
+	return doDetectRequest(s, detection.MakeHttpRequestInCtx(req, dc), d)
+}
+
+func DetectRequestInCtx(s io.ReadWriter, dc *detection.DetectionContext) (*detection.Result, error) {
+	return detectRequestInCtx(s, dc, defaultResultDecoder)
+}
+
+func DetectResponseInCtx(s io.ReadWriter, dc *detection.DetectionContext) (*detection.Result, error) {
+	return detectResponseInCtx(s, dc, defaultResultDecoder)
+}
+
+func Detect(s io.ReadWriter, dc *detection.DetectionContext) (*detection.Result, *detection.Result, error) {
+	return detect(s, dc, defaultResultDecoder)
+}
+
+func DetectHttpRequest(s io.ReadWriter, req *http.Request) (*detection.Result, error) {
+	return detectHttpRequest(s, req, defaultResultDecoder)
 }
 
 func DetectRequest(s io.ReadWriter, req detection.Request) (*detection.Result, error) {
-	return doDetectRequest(s, req)
+	return doDetectRequest(s, req, defaultResultDecoder)
 }
@@ -3,11 +3,16 @@ package t1k
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/t1k"
 
 	"github.com/chaitin/t1k-go/misc"
 )
@@ -90,3 +95,267 @@ func TestReadDetectResult(t *testing.T) {
 	}
 	fmt.Printf("%v\n", ret)
 }
+
+func readSections(t *testing.T, buf *bytes.Buffer) map[t1k.Tag][]byte {
+	sections := make(map[t1k.Tag][]byte)
+	for buf.Len() > 0 {
+		sec, err := t1k.ReadFullSection(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body bytes.Buffer
+		_ = sec.WriteBody(&body)
+		sections[sec.Header().Tag.Strip()] = body.Bytes()
+	}
+	return sections
+}
+
+func TestWriteDetectRequestBodyLimit(t *testing.T) {
+	body := "{\"name\": \"youcai\", \"password\": \"******\"}"
+	sReq := "POST /form.php HTTP/1.1\r\n" +
+		"Host: a.com\r\n" +
+		"Content-Length: 40\r\n" +
+		"Content-Type: application/json\r\n\r\n" + body
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer([]byte(sReq))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := detection.New()
+	dc.BodyLimit = 10
+	var buf bytes.Buffer
+	err = writeDetectionRequest(&buf, detection.MakeHttpRequestInCtx(req, dc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sections := readSections(t, &buf)
+	if string(sections[t1k.TAG_BODY]) != body[:10] {
+		t.Fatalf("unexpected inspected body %q", sections[t1k.TAG_BODY])
+	}
+	if !bytes.Contains(sections[t1k.TAG_EXTRA], []byte("BodyTruncated:y\n")) {
+		t.Fatalf("truncation not recorded in extra %q", sections[t1k.TAG_EXTRA])
+	}
+
+	upstream, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(upstream) != body {
+		t.Fatalf("upstream body mismatch %q", upstream)
+	}
+}
+
+func TestUserDataRoundTrip(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://a.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := detection.New()
+	dc.UserData = []byte("tenant=42")
+	var buf bytes.Buffer
+	err = writeDetectionRequest(&buf, detection.MakeHttpRequestInCtx(req, dc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := readSections(t, &buf)[t1k.TAG_USER_DATA]; string(data) != "tenant=42" {
+		t.Fatalf("unexpected user data section %q", data)
+	}
+
+	buf.Reset()
+	_ = t1k.WriteSection(t1k.MakeSimpleSection(t1k.TAG_HEADER|t1k.MASK_FIRST, []byte(".")), &buf)
+	_ = t1k.WriteSection(t1k.MakeSimpleSection(t1k.TAG_USER_DATA|t1k.MASK_LAST, []byte("principal=alice")), &buf)
+	ret, err := readDetectionResult(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ret.UserData) != "principal=alice" {
+		t.Fatalf("unexpected result user data %q", ret.UserData)
+	}
+}
+
+func TestWriteDetectRawRequestAndResponse(t *testing.T) {
+	// odd spacing and case must reach the detector unchanged
+	header := "POST /form.php?id=3 HTTP/1.0\r\n" +
+		"host:  a.com\r\n" +
+		"X-custom-Header: v\r\n\r\n"
+	body := "name=youcai&password=secret"
+	dc := detection.New()
+	dc.Protocol = ""
+	dc.BodyLimit = 4
+	req := detection.MakeRawRequestInCtx([]byte(header), strings.NewReader(body), int64(len(body)), dc)
+
+	var buf bytes.Buffer
+	if err := writeDetectionRequest(&buf, req); err != nil {
+		t.Fatal(err)
+	}
+	sections := readSections(t, &buf)
+	if string(sections[t1k.TAG_HEADER]) != header || string(sections[t1k.TAG_BODY]) != "name" {
+		t.Fatalf("unexpected sections %q", sections)
+	}
+	extra := string(sections[t1k.TAG_EXTRA])
+	if dc.Protocol != "HTTP/1.0" || !strings.Contains(extra, "UUID:"+dc.UUID+"\n") || !strings.HasSuffix(extra, "BodyTruncated:y\n") {
+		t.Fatalf("unexpected extra %q, protocol %q", extra, dc.Protocol)
+	}
+	upstream, _ := io.ReadAll(req.ReplayBody())
+	if string(upstream) != body {
+		t.Fatalf("upstream body mismatch %q", upstream)
+	}
+
+	rspHeader := "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+	rsp := detection.MakeRawResponseInCtx([]byte(rspHeader), nil, 0, dc)
+	buf.Reset()
+	if err := writeDetectionResponse(&buf, rsp); err != nil {
+		t.Fatal(err)
+	}
+	sections = readSections(t, &buf)
+	if string(sections[t1k.TAG_HEADER]) != header || string(sections[t1k.TAG_RSP_HEADER]) != rspHeader ||
+		len(sections[t1k.TAG_RSP_BODY]) != 0 || !bytes.Contains(sections[t1k.TAG_RSP_EXTRA], []byte("UUID:"+dc.UUID)) {
+		t.Fatalf("unexpected response sections %q", sections)
+	}
+}
+
+func TestHttpResponseHeaderGolden(t *testing.T) {
+	cases := []struct {
+		name string
+		rsp  *http.Response
+		want string
+	}{
+		{
+			name: "http/1.0",
+			rsp: &http.Response{
+				Status: "404 Not Found", StatusCode: 404, Proto: "HTTP/1.0", ProtoMajor: 1,
+				Header: http.Header{"Content-Type": {"text/html"}},
+			},
+			want: "HTTP/1.0 404 Not Found\r\nContent-Type: text/html\r\n\r\n",
+		},
+		{
+			name: "http/2",
+			rsp: &http.Response{
+				Status: "200 OK", StatusCode: 200, Proto: "HTTP/2.0", ProtoMajor: 2,
+				Header: http.Header{"X-B": {"2"}, "X-A": {"1", "3"}},
+			},
+			want: "HTTP/2.0 200 OK\r\nX-A: 1\r\nX-A: 3\r\nX-B: 2\r\n\r\n",
+		},
+		{
+			name: "no proto, no status text",
+			rsp:  &http.Response{StatusCode: 503, ProtoMajor: 1, ProtoMinor: 1},
+			want: "HTTP/1.1 503 Service Unavailable\r\n\r\n",
+		},
+		{
+			name: "code only",
+			rsp:  &http.Response{Status: "299", StatusCode: 299},
+			want: "HTTP/1.1 299 \r\n\r\n",
+		},
+		{
+			name: "custom reason",
+			rsp:  &http.Response{Status: "200 Fine", StatusCode: 200, Proto: "HTTP/1.1"},
+			want: "HTTP/1.1 200 Fine\r\n\r\n",
+		},
+		{
+			name: "trailers",
+			rsp: &http.Response{
+				Status: "200 OK", StatusCode: 200, Proto: "HTTP/1.1",
+				Header:  http.Header{"Trailer": {"X-Checksum, X-Late"}},
+				Trailer: http.Header{"X-Checksum": {"abc"}, "X-Late": nil},
+			},
+			want: "HTTP/1.1 200 OK\r\nTrailer: X-Checksum, X-Late\r\n\r\n",
+		},
+		{
+			name: "received trailers",
+			rsp: &http.Response{
+				Status: "200 OK", StatusCode: 200, Proto: "HTTP/1.1",
+				Header:  http.Header{"Content-Type": {"text/plain"}},
+				Trailer: http.Header{"X-Late": nil, "X-Checksum": {"abc"}},
+			},
+			want: "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTrailer: X-Checksum, X-Late\r\n\r\n",
+		},
+	}
+	for _, c := range cases {
+		dc := detection.New()
+		detection.MakeRawRequestInCtx([]byte("GET / HTTP/1.1\r\n\r\n"), nil, 0, dc)
+		c.rsp.Body = http.NoBody
+		var buf bytes.Buffer
+		if err := writeDetectionResponse(&buf, detection.MakeHttpResponseInCtx(c.rsp, dc)); err != nil {
+			t.Fatal(err)
+		}
+		got := readSections(t, &buf)[t1k.TAG_RSP_HEADER]
+		if string(got) != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestWriteDetectDecodedResponseBody(t *testing.T) {
+	body := "{\"card\": \"4111111111111111\"}"
+	var encoded bytes.Buffer
+	zw := gzip.NewWriter(&encoded)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	dc := detection.New()
+	dc.DecodeBody = true
+	detection.MakeRawRequestInCtx([]byte("GET / HTTP/1.1\r\n\r\n"), nil, 0, dc)
+	header := fmt.Sprintf("HTTP/1.1 200 OK\r\ncontent-encoding: gzip\r\nContent-Length: %d\r\nX-A: 1\r\n\r\n", encoded.Len())
+	rsp := detection.MakeRawResponseInCtx([]byte(header), bytes.NewReader(encoded.Bytes()), int64(encoded.Len()), dc)
+	var buf bytes.Buffer
+	if err := writeDetectionResponse(&buf, rsp); err != nil {
+		t.Fatal(err)
+	}
+	sections := readSections(t, &buf)
+	if got := sections[t1k.TAG_RSP_BODY]; string(got) != body {
+		t.Fatalf("got response body %q", got)
+	}
+	// the header describes the decoded body
+	if got := sections[t1k.TAG_RSP_HEADER]; string(got) != "HTTP/1.1 200 OK\r\nX-A: 1\r\n\r\n" {
+		t.Fatalf("got response header %q", got)
+	}
+	client, _ := io.ReadAll(rsp.ReplayBody())
+	if !bytes.Equal(client, encoded.Bytes()) {
+		t.Fatal("client body is not the encoded one")
+	}
+}
+
+func TestWriteDetectDecodedRequestBody(t *testing.T) {
+	body := "q=<script>alert(1)</script>"
+	var encoded bytes.Buffer
+	zw := gzip.NewWriter(&encoded)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	for _, c := range []struct {
+		payload []byte
+		decoded bool
+	}{
+		{encoded.Bytes(), true},
+		{[]byte("not gzip at all"), false},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(c.payload))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Content-Length", fmt.Sprint(len(c.payload)))
+		dc := detection.New()
+		dc.DecodeBody = true
+		var buf bytes.Buffer
+		if err := writeDetectionRequest(&buf, detection.MakeHttpRequestInCtx(req, dc)); err != nil {
+			t.Fatal(err)
+		}
+		sections := readSections(t, &buf)
+		header := string(sections[t1k.TAG_HEADER])
+		hasEncoding := strings.Contains(header, "Content-Encoding") || strings.Contains(header, "Content-Length")
+		if c.decoded == hasEncoding {
+			t.Fatalf("decoded %v, got header %q", c.decoded, header)
+		}
+		if c.decoded && string(sections[t1k.TAG_BODY]) != body {
+			t.Fatalf("got request body %q", sections[t1k.TAG_BODY])
+		}
+		// the header asked again, as with the response, stays the same
+		again, _ := dc.Request.Header()
+		if string(again) != header {
+			t.Fatalf("header changed to %q", again)
+		}
+		upstream, _ := io.ReadAll(req.Body)
+		if !bytes.Equal(upstream, c.payload) {
+			t.Fatal("upstream body is not the encoded one")
+		}
+	}
+}
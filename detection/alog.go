@@ -0,0 +1,206 @@
+package detection
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/chaitin/t1k-go/misc"
+)
+
+// fieldSet holds the fields of a JSON log object. Known fields are taken
+// out of it while decoding, what is left is kept as extra fields.
+type fieldSet map[string]json.RawMessage
+
+func decodeFields(b []byte) (fieldSet, error) {
+	var ret fieldSet
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	err := d.Decode(&ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// takeString accepts strings as well as numbers and booleans, as the type
+// of a field may change between detector versions.
+func (f fieldSet) takeString(key string) string {
+	raw, ok := f[key]
+	if !ok {
+		return ""
+	}
+	delete(f, key)
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	raw = bytes.TrimSpace(raw)
+	if bytes.Equal(raw, []byte("null")) {
+		return ""
+	}
+	return string(raw)
+}
+
+func (f fieldSet) takeInt(key string) int64 {
+	raw, ok := f[key]
+	if !ok {
+		return 0
+	}
+	s := f.takeString(key)
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		if v, errFloat := strconv.ParseFloat(s, 64); errFloat == nil {
+			return int64(v)
+		}
+		// keep what can not be understood
+		f[key] = raw
+		return 0
+	}
+	return n
+}
+
+func (f fieldSet) extra() map[string]json.RawMessage {
+	if len(f) == 0 {
+		return nil
+	}
+	return f
+}
+
+// marshalWithExtra encodes known fields of v merged with extra fields,
+// known fields winning.
+func marshalWithExtra(v interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return b, err
+	}
+	var known map[string]json.RawMessage
+	err = json.Unmarshal(b, &known)
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]json.RawMessage, len(known)+len(extra))
+	for k, raw := range extra {
+		merged[k] = raw
+	}
+	for k, raw := range known {
+		merged[k] = raw
+	}
+	return json.Marshal(merged)
+}
+
+// AttackEvent is the attack log the detector sends in TAG_ALOG.
+type AttackEvent struct {
+	EventID    string `json:"event_id,omitempty"`
+	RuleID     string `json:"rule_id,omitempty"`
+	AttackType string `json:"attack_type,omitempty"`
+	RiskLevel  string `json:"risk_level,omitempty"`
+	Action     string `json:"action,omitempty"`
+	Location   string `json:"location,omitempty"`
+	Payload    string `json:"payload,omitempty"`
+	Module     string `json:"module,omitempty"`
+	Timestamp  int64  `json:"timestamp,omitempty"`
+
+	// fields unknown to this version of the SDK
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func ParseAttackLog(b []byte) (*AttackEvent, error) {
+	f, err := decodeFields(b)
+	if err != nil {
+		return nil, misc.ErrorWrap(err, "decode attack log")
+	}
+	return &AttackEvent{
+		EventID:    f.takeString("event_id"),
+		RuleID:     f.takeString("rule_id"),
+		AttackType: f.takeString("attack_type"),
+		RiskLevel:  f.takeString("risk_level"),
+		Action:     f.takeString("action"),
+		Location:   f.takeString("location"),
+		Payload:    f.takeString("payload"),
+		Module:     f.takeString("module"),
+		Timestamp:  f.takeInt("timestamp"),
+		Extra:      f.extra(),
+	}, nil
+}
+
+// PayloadExcerpt returns Payload cut to at most n bytes.
+func (e *AttackEvent) PayloadExcerpt(n int) string {
+	if len(e.Payload) <= n {
+		return e.Payload
+	}
+	return e.Payload[:n]
+}
+
+// MarshalJSON keeps the unknown fields.
+func (e *AttackEvent) MarshalJSON() ([]byte, error) {
+	type plain AttackEvent
+	return marshalWithExtra((*plain)(e), e.Extra)
+}
+
+// WebLog is the access log the detector sends in TAG_WEB_LOG.
+type WebLog struct {
+	EventID    string `json:"event_id,omitempty"`
+	Timestamp  int64  `json:"timestamp,omitempty"`
+	SrcIP      string `json:"src_ip,omitempty"`
+	SrcPort    int64  `json:"src_port,omitempty"`
+	DstIP      string `json:"dst_ip,omitempty"`
+	DstPort    int64  `json:"dst_port,omitempty"`
+	Method     string `json:"method,omitempty"`
+	Host       string `json:"host,omitempty"`
+	URLPath    string `json:"url_path,omitempty"`
+	Query      string `json:"query_string,omitempty"`
+	StatusCode int64  `json:"status_code,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	Referer    string `json:"referer,omitempty"`
+	Action     string `json:"action,omitempty"`
+
+	// fields unknown to this version of the SDK
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func ParseWebLog(b []byte) (*WebLog, error) {
+	f, err := decodeFields(b)
+	if err != nil {
+		return nil, misc.ErrorWrap(err, "decode web log")
+	}
+	return &WebLog{
+		EventID:    f.takeString("event_id"),
+		Timestamp:  f.takeInt("timestamp"),
+		SrcIP:      f.takeString("src_ip"),
+		SrcPort:    f.takeInt("src_port"),
+		DstIP:      f.takeString("dst_ip"),
+		DstPort:    f.takeInt("dst_port"),
+		Method:     f.takeString("method"),
+		Host:       f.takeString("host"),
+		URLPath:    f.takeString("url_path"),
+		Query:      f.takeString("query_string"),
+		StatusCode: f.takeInt("status_code"),
+		UserAgent:  f.takeString("user_agent"),
+		Referer:    f.takeString("referer"),
+		Action:     f.takeString("action"),
+		Extra:      f.extra(),
+	}, nil
+}
+
+// MarshalJSON keeps the unknown fields.
+func (l *WebLog) MarshalJSON() ([]byte, error) {
+	type plain WebLog
+	return marshalWithExtra((*plain)(l), l.Extra)
+}
+
+// AttackEvent decodes Alog, it returns nil without error when there is none.
+func (r *Result) AttackEvent() (*AttackEvent, error) {
+	if len(bytes.TrimSpace(r.Alog)) == 0 {
+		return nil, nil
+	}
+	return ParseAttackLog(r.Alog)
+}
+
+// ParsedWebLog decodes WebLog, it returns nil without error when there is none.
+func (r *Result) ParsedWebLog() (*WebLog, error) {
+	if len(bytes.TrimSpace(r.WebLog)) == 0 {
+		return nil, nil
+	}
+	return ParseWebLog(r.WebLog)
+}
@@ -0,0 +1,55 @@
+package detection
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAttackLog(t *testing.T) {
+	r := &Result{
+		Alog: []byte(`{"event_id":"e1","rule_id":"m_sqli","attack_type":2,"risk_level":"high",` +
+			`"location":"urlpath","payload":"1' or '1'='1","timestamp":1700000000,"new_field":{"a":1}}`),
+	}
+	e, err := r.AttackEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.EventID != "e1" || e.RuleID != "m_sqli" || e.AttackType != "2" || e.RiskLevel != "high" ||
+		e.Location != "urlpath" || e.Timestamp != 1700000000 || e.PayloadExcerpt(4) != "1' o" {
+		t.Fatalf("unexpected attack event %+v", e)
+	}
+	if string(e.Extra["new_field"]) != `{"a":1}` {
+		t.Fatalf("unknown field not kept: %q", e.Extra)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	_ = json.Unmarshal(b, &m)
+	if m["rule_id"] != "m_sqli" || m["new_field"] == nil {
+		t.Fatalf("unexpected encoding %s", b)
+	}
+
+	if e, err = (&Result{}).AttackEvent(); e != nil || err != nil {
+		t.Fatalf("expect no attack event, got %v %v", e, err)
+	}
+	if _, err = ParseAttackLog([]byte("not json")); err == nil {
+		t.Fatal("expect decode error")
+	}
+}
+
+func TestParseWebLog(t *testing.T) {
+	l, err := ParseWebLog([]byte(`{"src_ip":"1.2.3.4","src_port":"5678","method":"GET","host":"a.com",` +
+		`"url_path":"/x","status_code":403,"timestamp":"soon"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.SrcIP != "1.2.3.4" || l.SrcPort != 5678 || l.Host != "a.com" || l.URLPath != "/x" || l.StatusCode != 403 {
+		t.Fatalf("unexpected web log %+v", l)
+	}
+	if l.Timestamp != 0 || string(l.Extra["timestamp"]) != `"soon"` {
+		t.Fatalf("malformed field should be kept: %+v", l)
+	}
+}
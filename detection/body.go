@@ -0,0 +1,102 @@
+package detection
+
+import (
+	"io"
+	"math"
+	"net/http"
+
+	"github.com/chaitin/t1k-go/misc"
+	"github.com/chaitin/t1k-go/t1k"
+)
+
+func inspectLimit(limit int64) int64 {
+	if limit <= 0 {
+		// keep room for the extra byte read to detect truncation
+		return math.MaxInt64 - 1
+	}
+	return limit
+}
+
+func (dc *DetectionContext) newSpool() *spool {
+	if dc == nil {
+		return newSpool(0, "")
+	}
+	return newSpool(dc.SpoolThreshold, dc.SpoolDir)
+}
+
+func (dc *DetectionContext) bodyLimit() int64 {
+	if dc == nil {
+		return inspectLimit(0)
+	}
+	return inspectLimit(dc.BodyLimit)
+}
+
+// inspectBody prepares body for inspection without buffering it as a whole.
+// The inspect reader yields at most dc.BodyLimit bytes and tees them into a
+// spool while they stream to the detector. The replay body then yields the
+// complete original body and removes the spool file on Close.
+//
+// When the length is unknown, the inspected part is spooled up front since
+// the section header needs its size. A nil body or http.NoBody has nothing
+// to inspect nor replay.
+func inspectBody(body io.ReadCloser, contentLength int64, dc *DetectionContext) (int64, io.Reader, io.ReadCloser, bool, error) {
+	if body == nil || body == http.NoBody {
+		return 0, nil, nil, false, nil
+	}
+	limit := dc.bodyLimit()
+	sp := dc.newSpool()
+	replay := &spooledBody{
+		spool:    sp,
+		original: body,
+	}
+	if contentLength >= 0 {
+		size := contentLength
+		if size > limit {
+			size = limit
+		}
+		inspect := io.TeeReader(io.LimitReader(body, size), sp)
+		return size, inspect, replay, contentLength > limit, nil
+	}
+	n, err := io.CopyN(sp, body, limit+1)
+	if err != nil && err != io.EOF {
+		return 0, nil, replay, false, err
+	}
+	size := n
+	if size > limit {
+		size = limit
+	}
+	return size, io.LimitReader(sp.Reader(), size), replay, n > limit, nil
+}
+
+// BodyOf returns the body of a Request or a Response, through LargeBody
+// when it provides it.
+func BodyOf(v interface {
+	Body() (uint32, io.ReadCloser, error)
+}) (int64, io.ReadCloser, error) {
+	if p, ok := v.(LargeBodyProvider); ok {
+		return p.LargeBody()
+	}
+	size, body, err := v.Body()
+	return int64(size), body, err
+}
+
+// sectionBody narrows the result of LargeBody to that of Body.
+func sectionBody(size int64, body io.ReadCloser, err error) (uint32, io.ReadCloser, error) {
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > math.MaxUint32 {
+		body.Close()
+		return 0, nil, misc.ErrorWrapf(t1k.ErrSectionTooLarge, "body of %d bytes", size)
+	}
+	return uint32(size), body, nil
+}
+
+// AppendTruncatedExtra tells the detector that it only got the beginning
+// of the body.
+func AppendTruncatedExtra(extra []byte, truncated bool) []byte {
+	if !truncated {
+		return extra
+	}
+	return append(extra, []byte("BodyTruncated:y\n")...)
+}
@@ -0,0 +1,52 @@
+package detection
+
+import (
+	"net/http"
+)
+
+// BotChallenge is a bot-protection challenge issued by the detector. Body
+// is the challenge page to serve to the client, Query names the query
+// parameter the page submits the answer in. Answers are detected like any
+// other request: the detector verifies them and lets the client through,
+// usually by setting a cookie, or challenges it again.
+type BotChallenge struct {
+	Query      []byte
+	Body       []byte
+	StatusCode int
+}
+
+func (r *Result) IsBotChallenge() bool {
+	return len(r.BotBody) > 0
+}
+
+// BotChallenge returns the challenge carried by r, or nil.
+func (r *Result) BotChallenge() *BotChallenge {
+	if !r.IsBotChallenge() {
+		return nil
+	}
+	statusCode := http.StatusOK
+	if len(r.Body) > 0 {
+		statusCode = r.StatusCode()
+	}
+	if statusCode < 200 || statusCode > 599 {
+		statusCode = http.StatusOK
+	}
+	return &BotChallenge{
+		Query:      r.BotQuery,
+		Body:       r.BotBody,
+		StatusCode: statusCode,
+	}
+}
+
+// BotAnswer returns the answer req carries to a challenge whose Query is
+// query, if any.
+func BotAnswer(req *http.Request, query []byte) (string, bool) {
+	if len(query) == 0 || req.URL == nil {
+		return "", false
+	}
+	values, ok := req.URL.Query()[string(query)]
+	if !ok || len(values) == 0 || values[0] == "" {
+		return "", false
+	}
+	return values[0], true
+}
@@ -19,10 +19,33 @@ type DetectionContext struct {
 	ReqBeginTime int64
 	RspBeginTime int64
 
+	// maximum number of body bytes sent to the detector, 0 means no
+	// limit; the upstream still gets the whole body. Bodies of 4 GiB or
+	// more sent in full are split across sections, see LargeBodyProvider
+	BodyLimit int64
+	// bodies larger than SpoolThreshold are spooled to a temporary file
+	// in SpoolDir while they stream to the detector
+	SpoolThreshold int64
+	SpoolDir       string
+	// gzip and deflate bodies are decoded for the detector when DecodeBody
+	// is set, up to MaxDecodedBody bytes, default 1MiB, and sent without
+	// their Content-Encoding and Content-Length fields; the upstream and
+	// the client still get the encoded body
+	DecodeBody     bool
+	MaxDecodedBody int64
+
 	T1KContext []byte
+	// application data sent along with the request and the response, for
+	// detector-side rules and logs, e.g. a tenant ID or an auth principal
+	UserData []byte
+	// the request is detected again after an outage, see package replay
+	Deferred bool
 
 	Request  Request
 	Response Response
+
+	// request result decided without the detector, see LocalResult
+	localResult *Result
 }
 
 func New() *DetectionContext {
@@ -84,5 +107,15 @@ func MakeContextWithRequest(req *http.Request) (*DetectionContext, error) {
 func (dc *DetectionContext) ProcessResult(r *Result) {
 	if r.Objective == RO_REQUEST {
 		dc.T1KContext = r.T1KContext
+		dc.localResult = nil
+		if r.IsLocal() {
+			dc.localResult = r
+		}
 	}
 }
+
+// LocalResult returns the request result processed last when a request
+// filter or the fallback decided it locally, nil otherwise.
+func (dc *DetectionContext) LocalResult() *Result {
+	return dc.localResult
+}
@@ -0,0 +1,241 @@
+package detection
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	DEFAULT_MAX_DECODED_BODY int64 = 1 << 20
+)
+
+// decoding returns the content coding to undo before inspection, gzip or
+// deflate, or "" when the body is sent as is.
+func (dc *DetectionContext) decoding(contentEncoding string) string {
+	if dc == nil || !dc.DecodeBody {
+		return ""
+	}
+	var ret string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		switch coding {
+		case "", "identity":
+			continue
+		case "x-gzip":
+			coding = "gzip"
+		}
+		if ret != "" || (coding != "gzip" && coding != "deflate") {
+			// stacked or unknown codings are not decoded
+			return ""
+		}
+		ret = coding
+	}
+	return ret
+}
+
+func contentEncoding(header http.Header) string {
+	return strings.Join(header.Values("Content-Encoding"), ",")
+}
+
+func (dc *DetectionContext) maxDecodedBody() int64 {
+	if dc.MaxDecodedBody <= 0 {
+		return DEFAULT_MAX_DECODED_BODY
+	}
+	return dc.MaxDecodedBody
+}
+
+func newDecoder(coding string, r io.Reader) (io.ReadCloser, error) {
+	if coding == "gzip" {
+		return gzip.NewReader(r)
+	}
+	// deflate is meant to be zlib-wrapped, some servers send it raw
+	br := bufio.NewReader(r)
+	b, err := br.Peek(2)
+	if err == nil && b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// errReader remembers the error of the underlying reader, to tell it from
+// a decoding error.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// inspection is a body prepared for the detector.
+type inspection struct {
+	size      int64
+	body      io.Reader // nil without a body
+	replay    io.ReadCloser
+	truncated bool
+	decoded   bool // the content coding was undone
+	err       error
+}
+
+// largeBody is the return of LargeBody for ins.
+func (ins *inspection) largeBody() (int64, io.ReadCloser, error) {
+	if ins.err != nil {
+		return 0, nil, ins.err
+	}
+	if ins.body == nil {
+		return 0, http.NoBody, nil
+	}
+	return ins.size, io.NopCloser(ins.body), nil
+}
+
+// bodyState lets Header know whether the body is sent decoded: a body to
+// decode is inspected ahead, when its header is asked for first, and kept
+// for LargeBody.
+type bodyState struct {
+	inspected bool
+	decoded   bool
+	ahead     *inspection
+}
+
+// decodeAhead inspects the body with inspect when it is to be decoded and
+// was not inspected yet, it tells whether the body is sent decoded.
+func (b *bodyState) decodeAhead(dc *DetectionContext, encoding string, inspect func() *inspection) bool {
+	if !b.inspected && dc.decoding(encoding) != "" {
+		b.ahead = b.take(inspect)
+	}
+	return b.decoded
+}
+
+// take returns the inspection made ahead, or inspects the body now.
+func (b *bodyState) take(inspect func() *inspection) *inspection {
+	ins := b.ahead
+	b.ahead = nil
+	if ins == nil {
+		ins = inspect()
+		b.inspected = true
+		b.decoded = ins.decoded
+	}
+	return ins
+}
+
+// inspectEncodedBody is inspectBody decoding the body first when
+// dc.DecodeBody is set and encoding is gzip or deflate.
+func inspectEncodedBody(body io.ReadCloser, contentLength int64, encoding string, dc *DetectionContext) *inspection {
+	if coding := dc.decoding(encoding); coding != "" && body != nil && body != http.NoBody {
+		return inspectDecoded(body, coding, dc)
+	}
+	ret := &inspection{}
+	ret.size, ret.body, ret.replay, ret.truncated, ret.err = inspectBody(body, contentLength, dc)
+	return ret
+}
+
+// inspectDecoded is inspectBody for encoded bodies. The encoded bytes the
+// decoder reads are spooled for the replay body, the decoded ones are
+// kept in memory up to the smaller of dc.BodyLimit and dc.MaxDecodedBody.
+// A body which does not decode at all is inspected as is.
+func inspectDecoded(body io.ReadCloser, coding string, dc *DetectionContext) *inspection {
+	limit := dc.bodyLimit()
+	if max := dc.maxDecodedBody(); max < limit {
+		limit = max
+	}
+	sp := dc.newSpool()
+	ret := &inspection{
+		replay: &spooledBody{
+			spool:    sp,
+			original: body,
+		},
+	}
+	raw := &errReader{r: io.TeeReader(body, sp)}
+	var decoded bytes.Buffer
+	var n int64
+	dec, err := newDecoder(coding, raw)
+	if err == nil {
+		n, err = io.CopyN(&decoded, dec, limit+1)
+		dec.Close()
+	}
+	if raw.err != nil {
+		ret.err = raw.err
+		return ret
+	}
+	if err != nil && err != io.EOF && n == 0 {
+		rawLimit := dc.bodyLimit()
+		if sp.size <= rawLimit {
+			_, err = io.CopyN(sp, body, rawLimit+1-sp.size)
+			if err != nil && err != io.EOF {
+				ret.err = err
+				return ret
+			}
+		}
+		ret.size = sp.size
+		if ret.size > rawLimit {
+			ret.size = rawLimit
+		}
+		ret.body = io.LimitReader(sp.Reader(), ret.size)
+		ret.truncated = sp.size > rawLimit
+		return ret
+	}
+	ret.size = n
+	if ret.size > limit {
+		ret.size = limit
+	}
+	ret.body = bytes.NewReader(decoded.Bytes()[:ret.size])
+	// a stream corrupted midway is inspected as far as it decoded
+	ret.truncated = n > limit || (err != nil && err != io.EOF)
+	ret.decoded = true
+	return ret
+}
+
+// encodingFields describe the encoded body, they are dropped from the
+// header sent along a decoded one.
+var encodingFields = []string{"Content-Encoding", "Content-Length"}
+
+func isEncodingField(name string) bool {
+	for _, field := range encodingFields {
+		if strings.EqualFold(name, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutEncodingFields(header http.Header) http.Header {
+	ret := header.Clone()
+	for _, field := range encodingFields {
+		ret.Del(field)
+	}
+	return ret
+}
+
+// rawWithoutEncodingFields is withoutEncodingFields for a raw header,
+// whose first line is the request or status line.
+func rawWithoutEncodingFields(header []byte) []byte {
+	ret := make([]byte, 0, len(header))
+	dropping := false
+	for i, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if i > 0 && len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			// a folded continuation of the previous field
+			if dropping {
+				continue
+			}
+		} else if i > 0 {
+			j := bytes.IndexByte(line, ':')
+			dropping = j > 0 && isEncodingField(string(bytes.TrimSpace(line[:j])))
+			if dropping {
+				continue
+			}
+		}
+		ret = append(ret, line...)
+	}
+	return ret
+}
@@ -0,0 +1,123 @@
+package detection
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+)
+
+func encode(t *testing.T, coding string, payload string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	if _, err := w.Write([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestInspectEncodedBody(t *testing.T) {
+	payload := "name=<script>alert(1)</script>"
+	cases := []struct {
+		coding   string
+		encoding string
+	}{
+		{"gzip", "gzip"},
+		{"gzip", "X-Gzip"},
+		{"deflate", "deflate"},
+		{"raw-deflate", "identity, deflate"},
+	}
+	for _, c := range cases {
+		encoded := encode(t, c.coding, payload)
+		dc := New()
+		dc.DecodeBody = true
+		body := io.NopCloser(bytes.NewReader(encoded))
+		ins := inspectEncodedBody(body, int64(len(encoded)), c.encoding, dc)
+		if ins.err != nil {
+			t.Fatal(ins.err)
+		}
+		sent, _ := io.ReadAll(ins.body)
+		if ins.size != int64(len(payload)) || ins.truncated || !ins.decoded || string(sent) != payload {
+			t.Fatalf("%s: got %q, size %d, truncated %v", c.encoding, sent, ins.size, ins.truncated)
+		}
+		upstream, _ := io.ReadAll(ins.replay)
+		if !bytes.Equal(upstream, encoded) {
+			t.Fatalf("%s: replayed body is not the encoded one", c.encoding)
+		}
+		ins.replay.Close()
+	}
+}
+
+func TestInspectEncodedBodyLimits(t *testing.T) {
+	// a small body decoding to a lot, like a zip bomb
+	payload := strings.Repeat("a", 1<<20)
+	encoded := encode(t, "gzip", payload)
+	dc := New()
+	dc.DecodeBody = true
+	dc.MaxDecodedBody = 1000
+	dc.BodyLimit = 4000
+	ins := inspectEncodedBody(io.NopCloser(bytes.NewReader(encoded)), -1, "gzip", dc)
+	if ins.err != nil {
+		t.Fatal(ins.err)
+	}
+	sent, _ := io.ReadAll(ins.body)
+	if ins.size != 1000 || !ins.truncated || string(sent) != payload[:1000] {
+		t.Fatalf("size %d truncated %v", ins.size, ins.truncated)
+	}
+	upstream, _ := io.ReadAll(ins.replay)
+	if !bytes.Equal(upstream, encoded) {
+		t.Fatal("replayed body is not the encoded one")
+	}
+}
+
+func TestInspectEncodedBodyFallback(t *testing.T) {
+	payload := "not gzip at all"
+	for _, decode := range []bool{true, false} {
+		dc := New()
+		dc.DecodeBody = decode
+		ins := inspectEncodedBody(io.NopCloser(strings.NewReader(payload)), int64(len(payload)), "gzip", dc)
+		if ins.err != nil {
+			t.Fatal(ins.err)
+		}
+		sent, _ := io.ReadAll(ins.body)
+		if ins.size != int64(len(payload)) || ins.truncated || ins.decoded || string(sent) != payload {
+			t.Fatalf("got %q, size %d, truncated %v", sent, ins.size, ins.truncated)
+		}
+		upstream, _ := io.ReadAll(ins.replay)
+		if string(upstream) != payload {
+			t.Fatalf("replayed body mismatch %q", upstream)
+		}
+	}
+
+	// stacked codings are sent as is
+	encoded := encode(t, "gzip", payload)
+	dc := New()
+	dc.DecodeBody = true
+	ins := inspectEncodedBody(io.NopCloser(bytes.NewReader(encoded)), int64(len(encoded)), "gzip, br", dc)
+	if ins.err != nil {
+		t.Fatal(ins.err)
+	}
+	if sent, _ := io.ReadAll(ins.body); !bytes.Equal(sent, encoded) {
+		t.Fatal("stacked codings decoded")
+	}
+}
+
+func TestRawWithoutEncodingFields(t *testing.T) {
+	header := "POST / HTTP/1.1\r\nHost: a\r\ncontent-encoding: gzip\r\n x-gzip\r\nContent-Length : 12\r\nX-A: 1\r\n\r\n"
+	want := "POST / HTTP/1.1\r\nHost: a\r\nX-A: 1\r\n\r\n"
+	if got := string(rawWithoutEncodingFields([]byte(header))); got != want {
+		t.Fatalf("got %q", got)
+	}
+}
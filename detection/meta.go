@@ -0,0 +1,45 @@
+package detection
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+
+	"github.com/chaitin/t1k-go/misc"
+)
+
+// RequestMeta is what event sinks and local filters need to know about a
+// request, taken from the header block sent to the detector.
+type RequestMeta struct {
+	Method string
+	URI    string
+	Path   string
+	Host   string
+	Header http.Header
+}
+
+func ParseRequestHeader(b []byte) (*RequestMeta, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, misc.ErrorWrap(err, "parse request header")
+	}
+	return &RequestMeta{
+		Method: req.Method,
+		URI:    req.RequestURI,
+		Path:   req.URL.Path,
+		Host:   req.Host,
+		Header: req.Header,
+	}, nil
+}
+
+func (dc *DetectionContext) RequestMeta() (*RequestMeta, error) {
+	if dc.Request == nil {
+		return nil, errors.New("no request in detection context")
+	}
+	header, err := dc.Request.Header()
+	if err != nil {
+		return nil, err
+	}
+	return ParseRequestHeader(header)
+}
@@ -0,0 +1,206 @@
+package detection
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/chaitin/t1k-go/misc"
+)
+
+func toReadCloser(r io.Reader) io.ReadCloser {
+	if r == nil {
+		return nil
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		return rc
+	}
+	return io.NopCloser(r)
+}
+
+// protocolOf returns the protocol of a request line, like HTTP/1.1.
+func protocolOf(header []byte) string {
+	line := header
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := bytes.Fields(line)
+	if len(fields) != 3 {
+		return ""
+	}
+	return string(fields[2])
+}
+
+// rawContentEncoding returns the Content-Encoding values of a raw header.
+func rawContentEncoding(header []byte) string {
+	var values []string
+	lines := bytes.Split(header, []byte("\n"))
+	for _, line := range lines[1:] {
+		i := bytes.IndexByte(line, ':')
+		if i > 0 && strings.EqualFold(string(bytes.TrimSpace(line[:i])), "Content-Encoding") {
+			values = append(values, string(bytes.TrimSpace(line[i+1:])))
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+// RawRequest is a request as received by a proxy not built on net/http.
+// The header, the request line and the header lines up to and including
+// the empty line, is sent to the detector as is. A size of -1 means the
+// body length is unknown.
+//
+// Detecting reads the body, the proxy must forward ReplayBody instead.
+type RawRequest struct {
+	header    []byte
+	body      io.ReadCloser
+	size      int64
+	dc        *DetectionContext // this is optional
+	truncated bool
+	state     bodyState
+}
+
+func MakeRawRequest(header []byte, body io.Reader, size int64) *RawRequest {
+	return &RawRequest{
+		header: header,
+		body:   toReadCloser(body),
+		size:   size,
+	}
+}
+
+func MakeRawRequestInCtx(header []byte, body io.Reader, size int64, dc *DetectionContext) *RawRequest {
+	ret := MakeRawRequest(header, body, size)
+	ret.dc = dc
+	dc.Request = ret
+	if dc.Protocol == "" {
+		dc.Protocol = protocolOf(header)
+	}
+	if dc.ReqBeginTime == 0 {
+		dc.ReqBeginTime = misc.Now()
+	}
+	return ret
+}
+
+func (r *RawRequest) Header() ([]byte, error) {
+	if r.state.decodeAhead(r.dc, rawContentEncoding(r.header), r.inspect) {
+		return rawWithoutEncodingFields(r.header), nil
+	}
+	return r.header, nil
+}
+
+func (r *RawRequest) Body() (uint32, io.ReadCloser, error) {
+	return sectionBody(r.LargeBody())
+}
+
+func (r *RawRequest) LargeBody() (int64, io.ReadCloser, error) {
+	size, body, err := r.state.take(r.inspect).largeBody()
+	return size, body, misc.ErrorWrap(err, "get body")
+}
+
+func (r *RawRequest) inspect() *inspection {
+	ins := inspectEncodedBody(r.body, r.size, rawContentEncoding(r.header), r.dc)
+	if ins.replay != nil {
+		r.body = ins.replay
+	}
+	r.truncated = ins.truncated
+	return ins
+}
+
+// ReplayBody returns the complete body, whether it was detected or not.
+// Closing it removes the spool file, if any.
+func (r *RawRequest) ReplayBody() io.ReadCloser {
+	if r.body == nil {
+		return http.NoBody
+	}
+	return r.body
+}
+
+func (r *RawRequest) Extra() ([]byte, error) {
+	if r.dc == nil {
+		return AppendTruncatedExtra(PlaceholderRequestExtra(misc.GenUUID()), r.truncated), nil
+	}
+	return AppendTruncatedExtra(GenRequestExtra(r.dc), r.truncated), nil
+}
+
+func (r *RawRequest) UserData() ([]byte, error) {
+	if r.dc == nil {
+		return nil, nil
+	}
+	return r.dc.UserData, nil
+}
+
+func (r *RawRequest) DetectionContext() *DetectionContext {
+	return r.dc
+}
+
+// RawResponse is the response counterpart of RawRequest, its header
+// starts with the status line.
+type RawResponse struct {
+	header    []byte
+	body      io.ReadCloser
+	size      int64
+	dc        *DetectionContext // this is a must-have
+	truncated bool
+	state     bodyState
+}
+
+func MakeRawResponseInCtx(header []byte, body io.Reader, size int64, dc *DetectionContext) *RawResponse {
+	ret := &RawResponse{
+		header: header,
+		body:   toReadCloser(body),
+		size:   size,
+		dc:     dc,
+	}
+	dc.Response = ret
+	dc.RspBeginTime = misc.Now()
+	return ret
+}
+
+func (r *RawResponse) RequestHeader() ([]byte, error) {
+	return r.dc.Request.Header()
+}
+
+func (r *RawResponse) Header() ([]byte, error) {
+	if r.state.decodeAhead(r.dc, rawContentEncoding(r.header), r.inspect) {
+		return rawWithoutEncodingFields(r.header), nil
+	}
+	return r.header, nil
+}
+
+func (r *RawResponse) Body() (uint32, io.ReadCloser, error) {
+	return sectionBody(r.LargeBody())
+}
+
+func (r *RawResponse) LargeBody() (int64, io.ReadCloser, error) {
+	size, body, err := r.state.take(r.inspect).largeBody()
+	return size, body, misc.ErrorWrap(err, "get body")
+}
+
+func (r *RawResponse) inspect() *inspection {
+	ins := inspectEncodedBody(r.body, r.size, rawContentEncoding(r.header), r.dc)
+	if ins.replay != nil {
+		r.body = ins.replay
+	}
+	r.truncated = ins.truncated
+	return ins
+}
+
+// ReplayBody returns the complete body, whether it was detected or not.
+func (r *RawResponse) ReplayBody() io.ReadCloser {
+	if r.body == nil {
+		return http.NoBody
+	}
+	return r.body
+}
+
+func (r *RawResponse) Extra() ([]byte, error) {
+	return AppendTruncatedExtra(GenResponseExtra(r.dc), r.truncated), nil
+}
+
+func (r *RawResponse) T1KContext() ([]byte, error) {
+	return r.dc.T1KContext, nil
+}
+
+func (r *RawResponse) UserData() ([]byte, error) {
+	return r.dc.UserData, nil
+}
@@ -18,9 +18,32 @@ type Request interface {
 	Extra() ([]byte, error)
 }
 
+// LargeBodyProvider is implemented by requests and responses whose body
+// size may not fit in the uint32 of Body, which then fails with
+// t1k.ErrSectionTooLarge. It is preferred over Body when sending the body,
+// a body of 4 GiB or more is then split across consecutive sections.
+type LargeBodyProvider interface {
+	LargeBody() (int64, io.ReadCloser, error)
+}
+
+// UserDataProvider is implemented by requests and responses carrying
+// application data to send in a TAG_USER_DATA section.
+type UserDataProvider interface {
+	UserData() ([]byte, error)
+}
+
+// ContextProvider is implemented by requests which know their context,
+// so that results of Server.DetectRequest still tell who sent them.
+type ContextProvider interface {
+	DetectionContext() *DetectionContext
+}
+
 type HttpRequest struct {
-	req *http.Request
-	dc  *DetectionContext // this is optional
+	req       *http.Request
+	dc        *DetectionContext // this is optional
+	truncated bool
+	raw       []byte // header block as received, if captured
+	state     bodyState
 }
 
 func MakeHttpRequest(req *http.Request) *HttpRequest {
@@ -85,7 +108,29 @@ func (r *HttpRequest) GetRemotePort() (uint16, error) {
 	return 0, errors.New("wrong value of port")
 }
 
+// HttpRequest returns the request r was made of.
+func (r *HttpRequest) HttpRequest() *http.Request {
+	return r.req
+}
+
+// UseRawHeader makes Header return the request line and header lines as
+// received, up to and including the empty line, instead of rebuilding
+// them from the parsed request.
+func (r *HttpRequest) UseRawHeader(header []byte) {
+	r.raw = header
+}
+
 func (r *HttpRequest) Header() ([]byte, error) {
+	decoded := r.state.decodeAhead(r.dc, contentEncoding(r.req.Header), r.inspect)
+	if r.raw != nil {
+		if r.dc != nil && r.dc.Protocol == "" {
+			r.dc.Protocol = protocolOf(r.raw)
+		}
+		if decoded {
+			return rawWithoutEncodingFields(r.raw), nil
+		}
+		return r.raw, nil
+	}
 	var buf bytes.Buffer
 	proto := r.req.Proto
 	if r.dc != nil {
@@ -104,7 +149,11 @@ func (r *HttpRequest) Header() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = r.req.Header.Write(&buf)
+	header := r.req.Header
+	if decoded {
+		header = withoutEncodingFields(header)
+	}
+	err = header.Write(&buf)
 	if err != nil {
 		return nil, err
 	}
@@ -115,18 +164,43 @@ func (r *HttpRequest) Header() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Body replaces the request body with one replaying it in full. Like any
+// request body the replacement must be closed, which removes its spool
+// file; it is closed anyway once the request context is done.
 func (r *HttpRequest) Body() (uint32, io.ReadCloser, error) {
-	bodyBytes, err := io.ReadAll(r.req.Body)
-	if err != nil {
-		return 0, nil, err
+	return sectionBody(r.LargeBody())
+}
+
+func (r *HttpRequest) LargeBody() (int64, io.ReadCloser, error) {
+	return r.state.take(r.inspect).largeBody()
+}
+
+func (r *HttpRequest) inspect() *inspection {
+	ins := inspectEncodedBody(r.req.Body, r.req.ContentLength, contentEncoding(r.req.Header), r.dc)
+	if ins.replay != nil {
+		if b, ok := ins.replay.(*spooledBody); ok {
+			b.closeOnDone(r.req.Context())
+		}
+		r.req.Body = ins.replay
 	}
-	r.req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-	return uint32(len(bodyBytes)), io.NopCloser(bytes.NewReader(bodyBytes)), nil
+	r.truncated = ins.truncated
+	return ins
 }
 
 func (r *HttpRequest) Extra() ([]byte, error) {
 	if r.dc == nil {
-		return PlaceholderRequestExtra(misc.GenUUID()), nil
+		return AppendTruncatedExtra(PlaceholderRequestExtra(misc.GenUUID()), r.truncated), nil
+	}
+	return AppendTruncatedExtra(GenRequestExtra(r.dc), r.truncated), nil
+}
+
+func (r *HttpRequest) DetectionContext() *DetectionContext {
+	return r.dc
+}
+
+func (r *HttpRequest) UserData() ([]byte, error) {
+	if r.dc == nil {
+		return nil, nil
 	}
-	return GenRequestExtra(r.dc), nil
+	return r.dc.UserData, nil
 }
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/chaitin/t1k-go/misc"
 )
@@ -18,8 +21,10 @@ type Response interface {
 }
 
 type HttpResponse struct {
-	rsp *http.Response
-	dc  *DetectionContext // this is a must-have
+	rsp       *http.Response
+	dc        *DetectionContext // this is a must-have
+	truncated bool
+	state     bodyState
 }
 
 func MakeHttpResponseInCtx(rsp *http.Response, dc *DetectionContext) *HttpResponse {
@@ -36,14 +41,20 @@ func (r *HttpResponse) RequestHeader() ([]byte, error) {
 	return r.dc.Request.Header()
 }
 
+// Header serializes the status line and the header of the response with
+// CRLF line endings. Trailer fields come after the body, they are only
+// declared by a Trailer field, as on the wire, when rsp.Header lacks it.
 func (r *HttpResponse) Header() ([]byte, error) {
 	var buf bytes.Buffer
-	statusLine := fmt.Sprintf("HTTP/1.1 %s\n", r.rsp.Status)
-	_, err := buf.Write([]byte(statusLine))
+	_, err := buf.WriteString(statusLine(r.rsp))
 	if err != nil {
 		return nil, err
 	}
-	err = r.rsp.Header.Write(&buf)
+	header := responseHeader(r.rsp)
+	if r.state.decodeAhead(r.dc, contentEncoding(r.rsp.Header), r.inspect) {
+		header = withoutEncodingFields(header)
+	}
+	err = header.Write(&buf)
 	if err != nil {
 		return nil, err
 	}
@@ -54,19 +65,75 @@ func (r *HttpResponse) Header() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// responseHeader returns the header of rsp declaring its trailers, net/http
+// moves the Trailer field of received responses to rsp.Trailer keys.
+func responseHeader(rsp *http.Response) http.Header {
+	if len(rsp.Trailer) == 0 || rsp.Header.Get("Trailer") != "" {
+		return rsp.Header
+	}
+	names := make([]string, 0, len(rsp.Trailer))
+	for name := range rsp.Trailer {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := rsp.Header.Clone()
+	if ret == nil {
+		ret = make(http.Header)
+	}
+	ret.Set("Trailer", strings.Join(names, ", "))
+	return ret
+}
+
+func statusLine(rsp *http.Response) string {
+	proto := rsp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+		if rsp.ProtoMajor > 0 {
+			proto = fmt.Sprintf("HTTP/%d.%d", rsp.ProtoMajor, rsp.ProtoMinor)
+		}
+	}
+	code := strconv.Itoa(rsp.StatusCode)
+	var text string
+	switch {
+	case strings.HasPrefix(rsp.Status, code+" "):
+		text = strings.TrimSpace(rsp.Status[len(code)+1:])
+	case rsp.Status != "" && rsp.Status != code:
+		// Status does not start with the code, keep it whole
+		return fmt.Sprintf("%s %s\r\n", proto, rsp.Status)
+	}
+	if text == "" {
+		text = http.StatusText(rsp.StatusCode)
+	}
+	// the space after the code is required even without a reason phrase
+	return fmt.Sprintf("%s %03d %s\r\n", proto, rsp.StatusCode, text)
+}
+
 func (r *HttpResponse) Body() (uint32, io.ReadCloser, error) {
-	bodyBytes, err := io.ReadAll(r.rsp.Body)
-	if err != nil {
-		return 0, nil, misc.ErrorWrapf(err, "get body size %d", len(bodyBytes))
+	return sectionBody(r.LargeBody())
+}
+
+func (r *HttpResponse) LargeBody() (int64, io.ReadCloser, error) {
+	size, body, err := r.state.take(r.inspect).largeBody()
+	return size, body, misc.ErrorWrap(err, "get body")
+}
+
+func (r *HttpResponse) inspect() *inspection {
+	ins := inspectEncodedBody(r.rsp.Body, r.rsp.ContentLength, contentEncoding(r.rsp.Header), r.dc)
+	if ins.replay != nil {
+		r.rsp.Body = ins.replay
 	}
-	r.rsp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-	return uint32(len(bodyBytes)), io.NopCloser(bytes.NewReader(bodyBytes)), nil
+	r.truncated = ins.truncated
+	return ins
 }
 
 func (r *HttpResponse) Extra() ([]byte, error) {
-	return GenResponseExtra(r.dc), nil
+	return AppendTruncatedExtra(GenResponseExtra(r.dc), r.truncated), nil
 }
 
 func (r *HttpResponse) T1KContext() ([]byte, error) {
 	return r.dc.T1KContext, nil
 }
+
+func (r *HttpResponse) UserData() ([]byte, error) {
+	return r.dc.UserData, nil
+}
@@ -1,10 +1,14 @@
 package detection
 
 import (
-	"log"
+	"fmt"
 	"net/http"
+	"net/textproto"
 	"regexp"
 	"strconv"
+	"strings"
+
+	"github.com/chaitin/t1k-go/t1k"
 )
 
 type ResultObjective int
@@ -14,6 +18,34 @@ const (
 	RO_RESPONSE ResultObjective = 1
 )
 
+// ResultOrigin tells whether a result comes from the detector or was
+// decided locally by the SDK without a round trip.
+type ResultOrigin int
+
+const (
+	ORIGIN_DETECTOR   ResultOrigin = 0
+	ORIGIN_IP_LIST    ResultOrigin = 1
+	ORIGIN_AUTO_BAN   ResultOrigin = 2
+	ORIGIN_RATE_LIMIT ResultOrigin = 3
+	ORIGIN_LOCAL_RULE ResultOrigin = 4
+)
+
+func (o ResultOrigin) String() string {
+	switch o {
+	case ORIGIN_DETECTOR:
+		return "detector"
+	case ORIGIN_IP_LIST:
+		return "ip-list"
+	case ORIGIN_AUTO_BAN:
+		return "auto-ban"
+	case ORIGIN_RATE_LIMIT:
+		return "rate-limit"
+	case ORIGIN_LOCAL_RULE:
+		return "local-rule"
+	}
+	return "unknown"
+}
+
 type Result struct {
 	Objective   ResultObjective
 	Head        byte
@@ -24,6 +56,55 @@ type Result struct {
 	T1KContext  []byte
 	Cookie      []byte
 	WebLog      []byte
+	BotQuery    []byte
+	BotBody     []byte
+	UserData    []byte
+
+	// sections without a handler in the decoder, keyed by stripped tag
+	Sections map[t1k.Tag][]byte
+
+	Origin ResultOrigin
+
+	// set by Prepare, Result stays a plain copyable value
+	prepared   bool
+	statusCode int
+	statusErr  error
+	eventID    string
+	eventIDErr error
+}
+
+// <!-- event_id: e1impksyjq0gl92le6odi0fnobi270cj -->
+var eventIDRegexp = regexp.MustCompile(`<\!--\s*event_id:\s*([a-zA-Z0-9]+)\s*-->\s*`)
+
+// MakeLocalResult builds a synthetic request result for a decision taken
+// without contacting the detector. A blocked result carries statusCode
+// as its body, the same way the detector reports it.
+func MakeLocalResult(origin ResultOrigin, passed bool, statusCode int) *Result {
+	ret := &Result{
+		Objective: RO_REQUEST,
+		Head:      '.',
+		Origin:    origin,
+	}
+	if !passed {
+		ret.Head = '?'
+		ret.Body = []byte(strconv.Itoa(statusCode))
+	}
+	ret.Prepare()
+	return ret
+}
+
+// Prepare parses the status code and the event ID up front, so that
+// StatusCode and EventID do not parse them again on every call. Body and
+// ExtraBody must not change afterwards. Results read from the detector are
+// prepared by the decoder.
+func (r *Result) Prepare() {
+	r.statusCode, r.statusErr = r.parseStatusCode()
+	r.eventID, r.eventIDErr = r.parseEventID()
+	r.prepared = true
+}
+
+func (r *Result) IsLocal() bool {
+	return r.Origin != ORIGIN_DETECTOR
 }
 
 func (r *Result) Passed() bool {
@@ -34,16 +115,31 @@ func (r *Result) Blocked() bool {
 	return !r.Passed()
 }
 
-func (r *Result) StatusCode() int {
+// ParseStatusCode returns the status code the detector asks to answer a
+// blocked request with, http.StatusForbidden when none is given.
+func (r *Result) ParseStatusCode() (int, error) {
+	if r.prepared {
+		return r.statusCode, r.statusErr
+	}
+	return r.parseStatusCode()
+}
+
+func (r *Result) parseStatusCode() (int, error) {
 	str := string(r.Body)
 	if str == "" {
-		return http.StatusForbidden
+		return http.StatusForbidden, nil
 	}
 	code, err := strconv.Atoi(str)
 	if err != nil {
-		log.Printf("t1k convert status code failed: %v", err)
-		return http.StatusForbidden
+		return http.StatusForbidden, fmt.Errorf("t1k convert status code failed: %w", err)
 	}
+	return code, nil
+}
+
+// StatusCode is like ParseStatusCode, falling back to
+// http.StatusForbidden on error.
+func (r *Result) StatusCode() int {
+	code, _ := r.ParseStatusCode()
 	return code
 }
 
@@ -56,21 +152,103 @@ func (r *Result) BlockMessage() map[string]interface{} {
 	}
 }
 
-func (r *Result) EventID() string {
+// ParseEventID returns the event ID embedded in the page of ExtraBody,
+// or an empty string when there is no such page.
+func (r *Result) ParseEventID() (string, error) {
+	if r.prepared {
+		return r.eventID, r.eventIDErr
+	}
+	return r.parseEventID()
+}
+
+func (r *Result) parseEventID() (string, error) {
 	extra := string(r.ExtraBody)
 	if extra == "" {
-		return ""
+		return "", nil
+	}
+	matches := eventIDRegexp.FindStringSubmatch(extra)
+	if len(matches) < 2 {
+		return "", fmt.Errorf("t1k regexp not match event id: %s", extra)
+	}
+	return matches[1], nil
+}
+
+// EventID is like ParseEventID, returning an empty string on error.
+func (r *Result) EventID() string {
+	eventID, _ := r.ParseEventID()
+	return eventID
+}
+
+func splitLines(b []byte) []string {
+	var ret []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) != "" {
+			ret = append(ret, line)
+		}
 	}
-	// <!-- event_id: e1impksyjq0gl92le6odi0fnobi270cj -->
-	re, err := regexp.Compile(`<\!--\s*event_id:\s*([a-zA-Z0-9]+)\s*-->\s*`)
+	return ret
+}
+
+// ParseExtraHeader parses the `Name: value` lines the detector sends in
+// ExtraHeader.
+func (r *Result) ParseExtraHeader() (http.Header, error) {
+	ret := make(http.Header)
+	for _, line := range splitLines(r.ExtraHeader) {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 || strings.ContainsAny(line[:i], " \t") {
+			return nil, fmt.Errorf("malformed extra header line %q", line)
+		}
+		key := textproto.CanonicalMIMEHeaderKey(line[:i])
+		ret.Add(key, strings.TrimSpace(line[i+1:]))
+	}
+	return ret, nil
+}
+
+// ParseCookies returns the Set-Cookie values the detector sends in Cookie,
+// one per line.
+func (r *Result) ParseCookies() []string {
+	var ret []string
+	for _, line := range splitLines(r.Cookie) {
+		if len(line) > len("Set-Cookie:") && strings.EqualFold(line[:len("Set-Cookie:")], "Set-Cookie:") {
+			line = line[len("Set-Cookie:"):]
+		}
+		ret = append(ret, strings.TrimSpace(line))
+	}
+	return ret
+}
+
+func (r *Result) applyToHeader(h http.Header) error {
+	extra, err := r.ParseExtraHeader()
 	if err != nil {
-		log.Printf("t1k compile regexp failed: %v", err)
-		return ""
+		return err
 	}
-	matches := re.FindStringSubmatch(extra)
-	if len(matches) < 2 {
-		log.Printf("t1k regexp not match event id: %s", extra)
-		return ""
+	for key, values := range extra {
+		if key == "Set-Cookie" {
+			for _, v := range values {
+				h.Add(key, v)
+			}
+			continue
+		}
+		h[key] = values
+	}
+	for _, cookie := range r.ParseCookies() {
+		h.Add("Set-Cookie", cookie)
+	}
+	return nil
+}
+
+// ApplyTo sets the headers and cookies requested by the detector on w, it
+// must be called before w.WriteHeader, whether the result passed or not.
+// Headers replace those already set, cookies are added.
+func (r *Result) ApplyTo(w http.ResponseWriter) error {
+	return r.applyToHeader(w.Header())
+}
+
+// ApplyToResponse is like ApplyTo for a response being proxied.
+func (r *Result) ApplyToResponse(rsp *http.Response) error {
+	if rsp.Header == nil {
+		rsp.Header = make(http.Header)
 	}
-	return matches[1]
+	return r.applyToHeader(rsp.Header)
 }
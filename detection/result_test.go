@@ -0,0 +1,41 @@
+package detection
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResultApplyTo(t *testing.T) {
+	r := &Result{
+		Head:        '.',
+		ExtraHeader: []byte("x-waf-id: 42\r\nCache-Control: no-store\r\nSet-Cookie: a=1\r\n\r\n"),
+		Cookie:      []byte("sl_session=xyz; Path=/; HttpOnly\nSet-Cookie: b=2\n"),
+	}
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Cache-Control", "max-age=60")
+	if err := r.ApplyTo(rec); err != nil {
+		t.Fatal(err)
+	}
+	h := rec.Header()
+	if h.Get("X-Waf-Id") != "42" || h.Get("Cache-Control") != "no-store" {
+		t.Fatalf("unexpected headers %v", h)
+	}
+	cookies := h.Values("Set-Cookie")
+	if len(cookies) != 3 || cookies[0] != "a=1" || cookies[1] != "sl_session=xyz; Path=/; HttpOnly" || cookies[2] != "b=2" {
+		t.Fatalf("unexpected cookies %q", cookies)
+	}
+
+	rsp := &http.Response{}
+	if err := r.ApplyToResponse(rsp); err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Cookies()) != 3 {
+		t.Fatalf("unexpected response cookies %v", rsp.Cookies())
+	}
+
+	r.ExtraHeader = []byte("not a header\r\n")
+	if err := r.ApplyTo(httptest.NewRecorder()); err == nil {
+		t.Fatal("expect error for malformed extra header")
+	}
+}
@@ -0,0 +1,165 @@
+package detection
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	DEFAULT_SPOOL_THRESHOLD int64 = 1 << 20
+)
+
+var errSpoolClosed = errors.New("spool already closed")
+
+// spool keeps the bytes written to it in memory until threshold is
+// exceeded, then moves them to a temporary file in dir.
+type spool struct {
+	threshold int64
+	dir       string
+	buf       bytes.Buffer
+	file      *os.File
+	size      int64
+	err       error
+	closed    bool
+}
+
+func newSpool(threshold int64, dir string) *spool {
+	if threshold <= 0 {
+		threshold = DEFAULT_SPOOL_THRESHOLD
+	}
+	return &spool{
+		threshold: threshold,
+		dir:       dir,
+	}
+}
+
+func (s *spool) spill() error {
+	f, err := os.CreateTemp(s.dir, "t1k-body-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(s.buf.Bytes())
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	s.file = f
+	s.buf = bytes.Buffer{}
+	return nil
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errSpoolClosed
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.file == nil && s.size+int64(len(p)) > s.threshold {
+		s.err = s.spill()
+		if s.err != nil {
+			return 0, s.err
+		}
+	}
+	var n int
+	if s.file != nil {
+		n, s.err = s.file.Write(p)
+	} else {
+		n, s.err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, s.err
+}
+
+// Reader returns an independent reader over everything written so far.
+func (s *spool) Reader() io.Reader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.buf.Bytes()[:s.size])
+}
+
+func (s *spool) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.buf = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	if errRemove := os.Remove(s.file.Name()); err == nil {
+		err = errRemove
+	}
+	return err
+}
+
+// spooledBody replays the spooled part of a body followed by whatever the
+// original body has not yet delivered. The replay starts on first Read so
+// that it covers everything spooled up to then.
+type spooledBody struct {
+	spool    *spool
+	original io.ReadCloser
+	reader   io.Reader
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func (b *spooledBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, errSpoolClosed
+	}
+	if b.reader == nil {
+		if b.spool.err != nil {
+			return 0, b.spool.err
+		}
+		b.reader = io.MultiReader(b.spool.Reader(), b.original)
+	}
+	return b.reader.Read(p)
+}
+
+func (b *spooledBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if b.done != nil {
+		close(b.done)
+	}
+	err := b.original.Close()
+	if errSpool := b.spool.Close(); err == nil {
+		err = errSpool
+	}
+	return err
+}
+
+// closeOnDone closes b once ctx is done, the way net/http closes the
+// original body of a server request, so that the spool is removed even
+// when nobody closes the replacement body.
+func (b *spooledBody) closeOnDone(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	b.mu.Lock()
+	b.done = make(chan struct{})
+	b.mu.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.Close()
+		case <-b.done:
+		}
+	}()
+}
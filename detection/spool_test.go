@@ -0,0 +1,101 @@
+package detection
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInspectBodySpillsToDisk(t *testing.T) {
+	dir := t.TempDir()
+	payload := strings.Repeat("0123456789", 1000)
+	dc := New()
+	dc.SpoolThreshold = 100
+	dc.SpoolDir = dir
+
+	for _, contentLength := range []int64{int64(len(payload)), -1} {
+		body := io.NopCloser(strings.NewReader(payload))
+		size, inspect, replay, truncated, err := inspectBody(body, contentLength, dc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(payload)) || truncated {
+			t.Fatalf("size %d truncated %v", size, truncated)
+		}
+		var sent bytes.Buffer
+		if _, err := io.CopyN(&sent, inspect, size); err != nil {
+			t.Fatal(err)
+		}
+		if sent.String() != payload {
+			t.Fatal("inspected body mismatch")
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 1 {
+			t.Fatalf("expect one spool file, got %d", len(files))
+		}
+		upstream, err := io.ReadAll(replay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(upstream) != payload {
+			t.Fatal("replayed body mismatch")
+		}
+		if err := replay.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 0 {
+			t.Fatalf("spool file not removed, %d left", len(files))
+		}
+	}
+}
+
+func TestInspectBodyTruncated(t *testing.T) {
+	payload := strings.Repeat("a", 64) + strings.Repeat("b", 64)
+	dc := New()
+	dc.BodyLimit = 64
+
+	for _, contentLength := range []int64{int64(len(payload)), -1} {
+		body := io.NopCloser(strings.NewReader(payload))
+		size, inspect, replay, truncated, err := inspectBody(body, contentLength, dc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != 64 || !truncated {
+			t.Fatalf("size %d truncated %v", size, truncated)
+		}
+		sent, _ := io.ReadAll(inspect)
+		if string(sent) != payload[:64] {
+			t.Fatalf("inspected body mismatch %q", sent)
+		}
+		upstream, _ := io.ReadAll(replay)
+		if string(upstream) != payload {
+			t.Fatalf("replayed body mismatch %q", upstream)
+		}
+		replay.Close()
+	}
+}
+
+func TestInspectNoBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if req.Body != http.NoBody {
+		t.Fatalf("unexpected body %T", req.Body)
+	}
+	dc, err := MakeContextWithRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, body, err := BodyOf(dc.Request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 || body != http.NoBody {
+		t.Fatalf("unexpected body of %d bytes %T", size, body)
+	}
+	// nothing to replay, the request keeps its body
+	if req.Body != http.NoBody {
+		t.Fatalf("body replaced by %T", req.Body)
+	}
+}
@@ -0,0 +1,50 @@
+package detection
+
+import (
+	"fmt"
+)
+
+type Verdict int
+
+const (
+	VERDICT_PASS      Verdict = 0
+	VERDICT_BLOCK     Verdict = 1
+	VERDICT_CHALLENGE Verdict = 2
+	// the detector answered with a head it does not use for verdicts,
+	// e.g. when it failed to process the request
+	VERDICT_ERROR Verdict = 3
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VERDICT_PASS:
+		return "pass"
+	case VERDICT_BLOCK:
+		return "block"
+	case VERDICT_CHALLENGE:
+		return "challenge"
+	case VERDICT_ERROR:
+		return "error"
+	}
+	return fmt.Sprintf("Verdict(%d)", int(v))
+}
+
+// Verdict derives the decision of the detector from Head and the body
+// sections. Unlike Blocked, which is true for any head but '.', it tells
+// a block apart from a challenge or an error. A block may still ask for
+// any status code, redirects included, see StatusCode.
+func (r *Result) Verdict() Verdict {
+	if r.IsBotChallenge() {
+		return VERDICT_CHALLENGE
+	}
+	switch r.Head {
+	case '.':
+		return VERDICT_PASS
+	case '?':
+		if _, err := r.ParseStatusCode(); err != nil {
+			return VERDICT_ERROR
+		}
+		return VERDICT_BLOCK
+	}
+	return VERDICT_ERROR
+}
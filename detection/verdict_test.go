@@ -0,0 +1,48 @@
+package detection
+
+import (
+	"testing"
+)
+
+func TestResultVerdict(t *testing.T) {
+	cases := []struct {
+		result *Result
+		expect Verdict
+	}{
+		{&Result{Head: '.'}, VERDICT_PASS},
+		{&Result{Head: '?'}, VERDICT_BLOCK},
+		{&Result{Head: '?', Body: []byte("403")}, VERDICT_BLOCK},
+		{&Result{Head: '?', Body: []byte("302")}, VERDICT_BLOCK},
+		{&Result{Head: '?', Body: []byte("oops")}, VERDICT_ERROR},
+		{&Result{Head: '?', BotBody: []byte("<html>")}, VERDICT_CHALLENGE},
+		{&Result{Head: '!'}, VERDICT_ERROR},
+		{&Result{}, VERDICT_ERROR},
+	}
+	for _, c := range cases {
+		if got := c.result.Verdict(); got != c.expect {
+			t.Errorf("Verdict of head %q body %q = %s, expect %s", c.result.Head, c.result.Body, got, c.expect)
+		}
+	}
+}
+
+func TestResultParseErrors(t *testing.T) {
+	r := &Result{Head: '?', Body: []byte("x"), ExtraBody: []byte("<html>no id</html>")}
+	if code, err := r.ParseStatusCode(); err == nil || code != 403 {
+		t.Fatalf("expect error and fallback code, got %d %v", code, err)
+	}
+	if _, err := r.ParseEventID(); err == nil {
+		t.Fatal("expect event id error")
+	}
+
+	r = &Result{Head: '?', Body: []byte("406"), ExtraBody: []byte("<!-- event_id: 8a7b6c -->")}
+	if r.StatusCode() != 406 || r.EventID() != "8a7b6c" {
+		t.Fatalf("unexpected %d %s", r.StatusCode(), r.EventID())
+	}
+
+	// a prepared result is copied with its parsed values
+	r.Prepare()
+	copied := *r
+	if copied.StatusCode() != 406 || copied.EventID() != "8a7b6c" {
+		t.Fatalf("unexpected copy %d %s", copied.StatusCode(), copied.EventID())
+	}
+}
@@ -0,0 +1,251 @@
+package event
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Formatter turns an event into the message of a syslog record.
+type Formatter interface {
+	Format(e *Event) string
+}
+
+// Product identifies the device in the header of CEF and LEEF messages.
+type Product struct {
+	Vendor  string
+	Product string
+	Version string
+}
+
+func (p *Product) orDefault() Product {
+	ret := Product{
+		Vendor:  "Chaitin",
+		Product: "SafeLine",
+		Version: "1.0",
+	}
+	if p == nil {
+		return ret
+	}
+	if p.Vendor != "" {
+		ret.Vendor = p.Vendor
+	}
+	if p.Product != "" {
+		ret.Product = p.Product
+	}
+	if p.Version != "" {
+		ret.Version = p.Version
+	}
+	return ret
+}
+
+// severity maps the risk level of the attack log to the 0-10 scale of
+// CEF and LEEF.
+func (e *Event) severity() int {
+	if e.Attack != nil {
+		switch strings.ToLower(e.Attack.RiskLevel) {
+		case "low":
+			return 3
+		case "medium":
+			return 5
+		case "high":
+			return 8
+		case "critical":
+			return 10
+		}
+		if n, err := strconv.Atoi(e.Attack.RiskLevel); err == nil && n >= 0 && n <= 10 {
+			return n
+		}
+	}
+	if e.Blocked() {
+		return 5
+	}
+	return 1
+}
+
+func (e *Event) signature() (string, string) {
+	if e.Attack != nil && e.Attack.AttackType != "" {
+		id := e.Attack.RuleID
+		if id == "" {
+			id = e.Attack.AttackType
+		}
+		return id, e.Attack.AttackType
+	}
+	return e.Verdict, fmt.Sprintf("%s %s", e.Objective, e.Verdict)
+}
+
+type field struct {
+	key   string
+	value string
+}
+
+// fields are the key-value pairs shared by CEF and LEEF, empty values are
+// left out by the formatters.
+func (e *Event) fields(keys map[string]string) []field {
+	port := func(p uint16) string {
+		if p == 0 {
+			return ""
+		}
+		return strconv.Itoa(int(p))
+	}
+	status := ""
+	if e.StatusCode != 0 {
+		status = strconv.Itoa(e.StatusCode)
+	}
+	ret := []field{
+		{keys["time"], strconv.FormatInt(e.Time.UnixNano()/1e6, 10)},
+		{keys["src"], e.RemoteAddr},
+		{keys["srcPort"], port(e.RemotePort)},
+		{keys["dst"], e.LocalAddr},
+		{keys["dstPort"], port(e.LocalPort)},
+		{keys["method"], e.Method},
+		{keys["host"], e.Host},
+		{keys["url"], e.URI},
+		{keys["action"], e.Verdict},
+		{keys["status"], status},
+		{keys["eventID"], e.EventID},
+		{keys["origin"], e.Origin},
+	}
+	if e.Attack != nil {
+		ret = append(ret,
+			field{keys["category"], e.Attack.AttackType},
+			field{keys["ruleID"], e.Attack.RuleID},
+			field{keys["location"], e.Attack.Location},
+			field{keys["payload"], e.Attack.PayloadExcerpt(256)},
+		)
+	}
+	return ret
+}
+
+var cefKeys = map[string]string{
+	"time":     "rt",
+	"src":      "src",
+	"srcPort":  "spt",
+	"dst":      "dst",
+	"dstPort":  "dpt",
+	"method":   "requestMethod",
+	"host":     "dhost",
+	"url":      "request",
+	"action":   "act",
+	"status":   "cn1",
+	"eventID":  "externalId",
+	"origin":   "cs1",
+	"category": "cat",
+	"ruleID":   "cs2",
+	"location": "cs3",
+	"payload":  "cs4",
+}
+
+var cefLabels = []field{
+	{"cn1Label", "statusCode"},
+	{"cs1Label", "origin"},
+	{"cs2Label", "ruleId"},
+	{"cs3Label", "location"},
+	{"cs4Label", "payload"},
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// CEF formats events as ArcSight Common Event Format.
+type CEF struct {
+	Product *Product
+}
+
+func (f *CEF) Format(e *Event) string {
+	e.Decode()
+	p := f.Product.orDefault()
+	id, name := e.signature()
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeaderEscaper.Replace(p.Vendor),
+		cefHeaderEscaper.Replace(p.Product),
+		cefHeaderEscaper.Replace(p.Version),
+		cefHeaderEscaper.Replace(id),
+		cefHeaderEscaper.Replace(name),
+		e.severity(),
+	)
+	first := true
+	used := make(map[string]bool)
+	for _, fd := range e.fields(cefKeys) {
+		if fd.value == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		used[fd.key] = true
+		b.WriteString(fd.key)
+		b.WriteByte('=')
+		b.WriteString(cefExtensionEscaper.Replace(fd.value))
+	}
+	for _, label := range cefLabels {
+		if !used[strings.TrimSuffix(label.key, "Label")] {
+			continue
+		}
+		b.WriteByte(' ')
+		b.WriteString(label.key)
+		b.WriteByte('=')
+		b.WriteString(label.value)
+	}
+	return b.String()
+}
+
+var leefKeys = map[string]string{
+	"time":     "devTime",
+	"src":      "src",
+	"srcPort":  "srcPort",
+	"dst":      "dst",
+	"dstPort":  "dstPort",
+	"method":   "method",
+	"host":     "host",
+	"url":      "url",
+	"action":   "action",
+	"status":   "statusCode",
+	"eventID":  "eventId",
+	"origin":   "origin",
+	"category": "cat",
+	"ruleID":   "ruleId",
+	"location": "location",
+	"payload":  "payload",
+}
+
+var (
+	leefHeaderEscaper = strings.NewReplacer(`|`, `\|`, "\r", " ", "\n", " ")
+	leefValueEscaper  = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+)
+
+// LEEF formats events as QRadar Log Event Extended Format 1.0, attributes
+// separated by tabs.
+type LEEF struct {
+	Product *Product
+}
+
+func (f *LEEF) Format(e *Event) string {
+	e.Decode()
+	p := f.Product.orDefault()
+	id, _ := e.signature()
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|",
+		leefHeaderEscaper.Replace(p.Vendor),
+		leefHeaderEscaper.Replace(p.Product),
+		leefHeaderEscaper.Replace(p.Version),
+		leefHeaderEscaper.Replace(id),
+	)
+	// devTime is in epoch milliseconds, which needs no devTimeFormat
+	b.WriteString("sev=")
+	b.WriteString(strconv.Itoa(e.severity()))
+	for _, fd := range e.fields(leefKeys) {
+		if fd.value == "" {
+			continue
+		}
+		b.WriteByte('\t')
+		b.WriteString(fd.key)
+		b.WriteByte('=')
+		b.WriteString(leefValueEscaper.Replace(fd.value))
+	}
+	return b.String()
+}
@@ -0,0 +1,39 @@
+package event
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+func attackEvent() *Event {
+	result := detection.MakeLocalResult(detection.ORIGIN_DETECTOR, false, 403)
+	result.Alog = []byte(`{"event_id":"abc","rule_id":"m_sqli","attack_type":"sqli","risk_level":"high","payload":"1=1|x"}`)
+	e := New(nil, result)
+	e.Time = time.Unix(1700000000, 0)
+	e.RemoteAddr = "192.0.2.1"
+	e.RemotePort = 4321
+	e.Method = "GET"
+	e.URI = "/q?a=1=1"
+	return e
+}
+
+func TestCEF(t *testing.T) {
+	got := (&CEF{Product: &Product{Product: "Edge|WAF"}}).Format(attackEvent())
+	want := `CEF:0|Chaitin|Edge\|WAF|1.0|m_sqli|sqli|8|rt=1700000000000 src=192.0.2.1 spt=4321 requestMethod=GET ` +
+		`request=/q?a\=1\=1 act=block cn1=403 cs1=detector cat=sqli cs2=m_sqli cs4=1\=1|x ` +
+		`cn1Label=statusCode cs1Label=origin cs2Label=ruleId cs4Label=payload`
+	if got != want {
+		t.Fatalf("unexpected cef\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestLEEF(t *testing.T) {
+	got := (&LEEF{}).Format(attackEvent())
+	want := "LEEF:1.0|Chaitin|SafeLine|1.0|m_sqli|sev=8\tdevTime=1700000000000\tsrc=192.0.2.1\tsrcPort=4321" +
+		"\tmethod=GET\turl=/q?a=1=1\taction=block\tstatusCode=403\torigin=detector\tcat=sqli\truleId=m_sqli\tpayload=1=1|x"
+	if got != want {
+		t.Fatalf("unexpected leef\n got %q\nwant %q", got, want)
+	}
+}
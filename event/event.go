@@ -0,0 +1,140 @@
+package event
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+// Event is a detection outcome together with the request it is about,
+// snapshotted so that it stays valid once the DetectionContext is reused.
+// The request line and the logs are only decoded by Decode, so that
+// building an event costs little on the detection path.
+type Event struct {
+	Time       time.Time `json:"time"`
+	UUID       string    `json:"uuid,omitempty"`
+	Scheme     string    `json:"scheme,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	RemotePort uint16    `json:"remote_port,omitempty"`
+	LocalAddr  string    `json:"local_addr,omitempty"`
+	LocalPort  uint16    `json:"local_port,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	URI        string    `json:"uri,omitempty"`
+	Path       string    `json:"path,omitempty"`
+
+	Objective  string `json:"objective"`
+	Verdict    string `json:"verdict"`
+	Origin     string `json:"origin"`
+	StatusCode int    `json:"status_code,omitempty"`
+	EventID    string `json:"event_id,omitempty"`
+
+	Attack *detection.AttackEvent `json:"attack,omitempty"`
+	WebLog *detection.WebLog      `json:"web_log,omitempty"`
+	// raw logs which could not be decoded
+	RawAlog   string `json:"raw_alog,omitempty"`
+	RawWebLog string `json:"raw_web_log,omitempty"`
+
+	// detected after the fact, once the detector was back
+	Replayed bool `json:"replayed,omitempty"`
+
+	Result *detection.Result `json:"-"`
+
+	header     []byte
+	decodeOnce sync.Once
+}
+
+// Sink receives the events of a Server. Emit is called on the detection
+// path and must not block, sinks call Decode off that path before reading
+// the request line and the logs.
+type Sink interface {
+	Emit(e *Event)
+}
+
+// BlockedOnly is implemented by sinks which ignore passed results, the
+// Server then builds no event for a pass unless another sink wants it.
+type BlockedOnly interface {
+	OnlyBlocked() bool
+}
+
+func objectiveString(o detection.ResultObjective) string {
+	if o == detection.RO_RESPONSE {
+		return "response"
+	}
+	return "request"
+}
+
+// New builds the event of result, dc may be nil when the request was
+// detected without a context.
+func New(dc *detection.DetectionContext, result *detection.Result) *Event {
+	verdict := result.Verdict()
+	ret := &Event{
+		Time:      time.Now(),
+		Objective: objectiveString(result.Objective),
+		Verdict:   verdict.String(),
+		Origin:    result.Origin.String(),
+		EventID:   result.EventID(),
+		Result:    result,
+	}
+	if verdict != detection.VERDICT_PASS {
+		ret.StatusCode = result.StatusCode()
+	}
+	if dc == nil {
+		return ret
+	}
+	ret.UUID = dc.UUID
+	ret.Scheme = dc.Scheme
+	ret.Protocol = dc.Protocol
+	ret.RemoteAddr = dc.RemoteAddr
+	ret.RemotePort = dc.RemotePort
+	ret.LocalAddr = dc.LocalAddr
+	ret.LocalPort = dc.LocalPort
+	ret.Replayed = dc.Deferred
+	if dc.Request != nil {
+		ret.header, _ = dc.Request.Header()
+	}
+	return ret
+}
+
+// Decode fills in the request line and the logs of e, it may be called
+// any number of times from any goroutine.
+func (e *Event) Decode() *Event {
+	e.decodeOnce.Do(func() {
+		if attack, err := e.Result.AttackEvent(); err == nil {
+			e.Attack = attack
+		} else {
+			e.RawAlog = string(e.Result.Alog)
+		}
+		if webLog, err := e.Result.ParsedWebLog(); err == nil {
+			e.WebLog = webLog
+		} else {
+			e.RawWebLog = string(e.Result.WebLog)
+		}
+		if e.header == nil {
+			return
+		}
+		if meta, err := detection.ParseRequestHeader(e.header); err == nil {
+			e.Method = meta.Method
+			e.Host = meta.Host
+			e.URI = meta.URI
+			e.Path = meta.Path
+		}
+		e.header = nil
+	})
+	return e
+}
+
+func (e *Event) Blocked() bool {
+	return e.Result != nil && e.Result.Blocked()
+}
+
+func (e *Event) MarshalJSONL() ([]byte, error) {
+	b, err := json.Marshal(e.Decode())
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
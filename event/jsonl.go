@@ -0,0 +1,179 @@
+package event
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/chaitin/t1k-go/misc"
+)
+
+type JSONLConfig struct {
+	Path        string        // like /var/log/t1k/events.jsonl
+	MaxSize     int64         // rotate once the file exceeds it, 0 to disable
+	MaxAge      time.Duration // rotate once the file is that old, 0 to disable
+	MaxBackups  int           // rotated files to keep, 0 keeps all
+	BufferSize  int           // events queued before dropping, default 1024
+	OnlyBlocked bool
+	ErrorHook   func(error)
+}
+
+// JSONLSink writes events as JSON Lines from a background goroutine, so
+// that detection does not wait for the disk.
+type JSONLSink struct {
+	*queue
+	config *JSONLConfig
+
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	openedAt time.Time
+}
+
+func NewJSONLSink(config *JSONLConfig) (*JSONLSink, error) {
+	if config.Path == "" {
+		return nil, errors.New("empty jsonl sink path")
+	}
+	ret := &JSONLSink{
+		queue:  newQueue(config.BufferSize, config.OnlyBlocked, config.ErrorHook),
+		config: config,
+	}
+	err := ret.open()
+	if err != nil {
+		return nil, err
+	}
+	go ret.run()
+	return ret, nil
+}
+
+func (s *JSONLSink) open() error {
+	err := os.MkdirAll(filepath.Dir(s.config.Path), 0755)
+	if err != nil {
+		return misc.ErrorWrap(err, "")
+	}
+	f, err := os.OpenFile(s.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return misc.ErrorWrap(err, "")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return misc.ErrorWrap(err, "")
+	}
+	s.file = f
+	s.writer = bufio.NewWriter(f)
+	s.size = info.Size()
+	s.openedAt = time.Now()
+	return nil
+}
+
+func (s *JSONLSink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.writer.Flush()
+	if errClose := s.file.Close(); err == nil {
+		err = errClose
+	}
+	s.file = nil
+	return err
+}
+
+func (s *JSONLSink) needRotate(now time.Time) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.config.MaxSize > 0 && s.size >= s.config.MaxSize {
+		return true
+	}
+	return s.config.MaxAge > 0 && now.Sub(s.openedAt) >= s.config.MaxAge
+}
+
+func (s *JSONLSink) rotate(now time.Time) error {
+	err := s.closeFile()
+	if err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.%s", s.config.Path, now.Format("20060102-150405.000000"))
+	err = os.Rename(s.config.Path, backup)
+	if err != nil {
+		return misc.ErrorWrap(err, "rotate")
+	}
+	s.pruneBackups()
+	return s.open()
+}
+
+func (s *JSONLSink) pruneBackups() {
+	if s.config.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(s.config.Path + ".*")
+	if err != nil {
+		s.onErr(err)
+		return
+	}
+	// timestamps sort chronologically
+	sort.Strings(backups)
+	for len(backups) > s.config.MaxBackups {
+		s.onErr(os.Remove(backups[0]))
+		backups = backups[1:]
+	}
+}
+
+func (s *JSONLSink) write(e *Event) {
+	now := time.Now()
+	if s.file == nil {
+		// a previous rotation failed, retry
+		if err := s.open(); err != nil {
+			s.onErr(err)
+			return
+		}
+	}
+	if s.needRotate(now) {
+		if err := s.rotate(now); err != nil {
+			s.onErr(err)
+			if s.file == nil {
+				return
+			}
+		}
+	}
+	b, err := e.MarshalJSONL()
+	if err != nil {
+		s.onErr(err)
+		return
+	}
+	n, err := s.writer.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		s.onErr(err)
+		return
+	}
+	s.onWritten()
+}
+
+func (s *JSONLSink) run() {
+	defer close(s.doneCh)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-s.ch:
+			if !ok {
+				s.onErr(s.closeFile())
+				return
+			}
+			s.write(e)
+			if len(s.ch) == 0 && s.file != nil {
+				s.onErr(s.writer.Flush())
+			}
+		case now := <-ticker.C:
+			if s.file != nil && s.needRotate(now) {
+				s.onErr(s.rotate(now))
+			}
+		}
+	}
+}
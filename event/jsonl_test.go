@@ -0,0 +1,95 @@
+package event
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+func readLines(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ret []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("bad line %q: %v", scanner.Text(), err)
+		}
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+func blockedEvent() *Event {
+	ret := detection.MakeLocalResult(detection.ORIGIN_IP_LIST, false, 403)
+	return New(nil, ret)
+}
+
+func TestJSONLSinkWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sink, err := NewJSONLSink(&JSONLConfig{Path: path, OnlyBlocked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Emit(New(nil, detection.MakeLocalResult(detection.ORIGIN_IP_LIST, true, 0)))
+	sink.Emit(blockedEvent())
+	sink.Close()
+
+	lines := readLines(t, path)
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %d", len(lines))
+	}
+	if lines[0]["verdict"] != "block" || lines[0]["origin"] != "ip-list" || lines[0]["status_code"] != float64(403) {
+		t.Fatalf("unexpected event %v", lines[0])
+	}
+	if stats := sink.Stats(); stats.Written != 1 || stats.Dropped != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestJSONLSinkRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+	sink, err := NewJSONLSink(&JSONLConfig{Path: path, MaxSize: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		sink.Emit(blockedEvent())
+		// backups are named after the rotation time
+		time.Sleep(2 * time.Millisecond)
+	}
+	sink.Close()
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+	for _, p := range append(backups, path) {
+		if n := len(readLines(t, p)); n != 1 {
+			t.Fatalf("expected 1 line in %s, got %d", p, n)
+		}
+	}
+}
+
+func TestJSONLSinkDrop(t *testing.T) {
+	sink := &JSONLSink{
+		queue:  newQueue(1, false, nil),
+		config: &JSONLConfig{},
+	}
+	// no writer running, the second event does not fit
+	sink.Emit(blockedEvent())
+	sink.Emit(blockedEvent())
+	if stats := sink.Stats(); stats.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,91 @@
+package event
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DEFAULT_SINK_BUFFER_SIZE = 1024
+)
+
+type SinkStats struct {
+	Written uint64
+	Dropped uint64
+	Errors  uint64
+}
+
+// queue is the bounded buffer between Emit on the detection path and the
+// goroutine of a sink doing the I/O. Events emitted while it is full are
+// dropped and counted.
+type queue struct {
+	// accessed atomically, kept first for alignment
+	written uint64
+	dropped uint64
+	errors  uint64
+
+	ch          chan *Event
+	doneCh      chan struct{}
+	onlyBlocked bool
+	errorHook   func(error)
+	closeOnce   sync.Once
+}
+
+func newQueue(bufferSize int, onlyBlocked bool, errorHook func(error)) *queue {
+	if bufferSize <= 0 {
+		bufferSize = DEFAULT_SINK_BUFFER_SIZE
+	}
+	return &queue{
+		ch:          make(chan *Event, bufferSize),
+		doneCh:      make(chan struct{}),
+		onlyBlocked: onlyBlocked,
+		errorHook:   errorHook,
+	}
+}
+
+func (q *queue) Emit(e *Event) {
+	if q.onlyBlocked && !e.Blocked() {
+		return
+	}
+	select {
+	case q.ch <- e:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+func (q *queue) OnlyBlocked() bool {
+	return q.onlyBlocked
+}
+
+func (q *queue) Stats() SinkStats {
+	return SinkStats{
+		Written: atomic.LoadUint64(&q.written),
+		Dropped: atomic.LoadUint64(&q.dropped),
+		Errors:  atomic.LoadUint64(&q.errors),
+	}
+}
+
+// Close handles the queued events and waits for the sink to stop. Emit
+// must not be called afterwards.
+func (q *queue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.ch)
+	})
+	<-q.doneCh
+	return nil
+}
+
+func (q *queue) onWritten() {
+	atomic.AddUint64(&q.written, 1)
+}
+
+func (q *queue) onErr(err error) {
+	if err == nil {
+		return
+	}
+	atomic.AddUint64(&q.errors, 1)
+	if q.errorHook != nil {
+		q.errorHook(err)
+	}
+}
@@ -0,0 +1,202 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chaitin/t1k-go/misc"
+)
+
+const (
+	DEFAULT_SYSLOG_FACILITY        = 16 // local0
+	DEFAULT_SYSLOG_DIAL_TIMEOUT    = 3 * time.Second
+	DEFAULT_SYSLOG_RECONNECT_DELAY = time.Second
+
+	syslogSeverityWarning = 4
+	syslogSeverityInfo    = 6
+
+	// RFC 5424 TIME-SECFRAC allows at most 6 fractional digits
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+type SyslogConfig struct {
+	Network        string // udp, tcp, unix or unixgram
+	Addr           string // host:port, or the socket path like /dev/log
+	Facility       int    // default local0
+	Hostname       string // default os.Hostname()
+	AppName        string // default t1k
+	Formatter      Formatter
+	DialTimeout    time.Duration // for writes as well
+	ReconnectDelay time.Duration // least time between two dials
+	BufferSize     int
+	OnlyBlocked    bool
+	ErrorHook      func(error)
+}
+
+// SyslogSink sends events as RFC 5424 syslog messages. Stream transports
+// use octet counting framing (RFC 6587). A broken connection is dialed
+// again on the next event, events arriving while the collector can not be
+// reached are counted as errors.
+type SyslogSink struct {
+	*queue
+	config    *SyslogConfig
+	hostname  string
+	appName   string
+	formatter Formatter
+	stream    bool
+
+	conn     net.Conn
+	lastDial time.Time
+}
+
+func NewSyslogSink(config *SyslogConfig) (*SyslogSink, error) {
+	var stream bool
+	switch config.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		stream = true
+	case "udp", "udp4", "udp6", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", config.Network)
+	}
+	if config.Addr == "" {
+		return nil, errors.New("empty syslog address")
+	}
+	ret := &SyslogSink{
+		queue:     newQueue(config.BufferSize, config.OnlyBlocked, config.ErrorHook),
+		config:    config,
+		hostname:  config.Hostname,
+		appName:   config.AppName,
+		formatter: config.Formatter,
+		stream:    stream,
+	}
+	if ret.hostname == "" {
+		ret.hostname, _ = os.Hostname()
+	}
+	if ret.appName == "" {
+		ret.appName = "t1k"
+	}
+	if ret.formatter == nil {
+		ret.formatter = &CEF{}
+	}
+	// a collector which is down at startup is not fatal
+	ret.onErr(ret.dial())
+	go ret.run()
+	return ret, nil
+}
+
+// syslog header fields are printable US-ASCII without spaces, "-" if empty
+func headerField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	if len(s) > max {
+		s = s[:max]
+	}
+	return s
+}
+
+// Message builds the RFC 5424 record of e, without transport framing.
+func (s *SyslogSink) Message(e *Event) []byte {
+	facility := s.config.Facility
+	if facility <= 0 {
+		facility = DEFAULT_SYSLOG_FACILITY
+	}
+	severity := syslogSeverityInfo
+	if e.Blocked() {
+		severity = syslogSeverityWarning
+	}
+	msgID := "t1k-" + e.Verdict
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		facility*8+severity,
+		e.Time.UTC().Format(syslogTimeFormat),
+		headerField(s.hostname, 255),
+		headerField(s.appName, 48),
+		os.Getpid(),
+		headerField(msgID, 32),
+		s.formatter.Format(e),
+	))
+}
+
+func (s *SyslogSink) timeout() time.Duration {
+	if s.config.DialTimeout <= 0 {
+		return DEFAULT_SYSLOG_DIAL_TIMEOUT
+	}
+	return s.config.DialTimeout
+}
+
+func (s *SyslogSink) dial() error {
+	s.lastDial = time.Now()
+	conn, err := net.DialTimeout(s.config.Network, s.config.Addr, s.timeout())
+	if err != nil {
+		return misc.ErrorWrap(err, "dial syslog")
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *SyslogSink) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *SyslogSink) send(msg []byte) error {
+	if s.conn == nil {
+		delay := s.config.ReconnectDelay
+		if delay <= 0 {
+			delay = DEFAULT_SYSLOG_RECONNECT_DELAY
+		}
+		if time.Since(s.lastDial) < delay {
+			return errors.New("syslog not connected")
+		}
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	if s.stream {
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+	// a stalled collector must not hold the queue forever
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout()))
+	_, err := s.conn.Write(msg)
+	if err != nil {
+		s.closeConn()
+		return misc.ErrorWrap(err, "write syslog")
+	}
+	return nil
+}
+
+func (s *SyslogSink) write(e *Event) {
+	msg := s.Message(e)
+	connected := s.conn != nil
+	err := s.send(msg)
+	if err != nil && connected && s.stream {
+		// the peer may have closed an idle connection, try a fresh one
+		s.lastDial = time.Time{}
+		err = s.send(msg)
+	}
+	if err != nil {
+		s.onErr(err)
+		return
+	}
+	s.onWritten()
+}
+
+func (s *SyslogSink) run() {
+	defer close(s.doneCh)
+	defer s.closeConn()
+	for e := range s.ch {
+		s.write(e)
+	}
+}
@@ -0,0 +1,142 @@
+package event
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var syslogRegexp = regexp.MustCompile(`^<132>1 \S+ host t1k \d+ t1k-block - CEF:0\|`)
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	sink, err := NewSyslogSink(&SyslogConfig{Network: "udp", Addr: pc.LocalAddr().String(), Hostname: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.Emit(attackEvent())
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !syslogRegexp.Match(buf[:n]) {
+		t.Fatalf("unexpected message %q", buf[:n])
+	}
+}
+
+func TestSyslogTimestamp(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	sink, err := NewSyslogSink(&SyslogConfig{Network: "udp", Addr: pc.LocalAddr().String(), Hostname: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	e := attackEvent()
+	e.Time = time.Date(2023, 11, 14, 23, 13, 20, 123456789, time.FixedZone("CET", 3600))
+	fields := strings.SplitN(string(sink.Message(e)), " ", 3)
+	if fields[1] != "2023-11-14T22:13:20.123456Z" {
+		t.Fatalf("unexpected timestamp %q", fields[1])
+	}
+	frac := fields[1][strings.IndexByte(fields[1], '.')+1 : len(fields[1])-1]
+	if len(frac) > 6 {
+		t.Fatalf("timestamp %q has more than 6 fractional digits", fields[1])
+	}
+}
+
+func TestSyslogUnixgram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pc.Close()
+	sink, err := NewSyslogSink(&SyslogConfig{Network: "unixgram", Addr: path, Hostname: "host", Formatter: &LEEF{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.Emit(attackEvent())
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf[:n]), " - LEEF:1.0|") {
+		t.Fatalf("unexpected message %q", buf[:n])
+	}
+}
+
+func readFramed(t *testing.T, r *bufio.Reader) string {
+	size, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestSyslogTCPReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	// the collector is down when the sink starts
+	l.Close()
+
+	sink, err := NewSyslogSink(&SyslogConfig{Network: "tcp", Addr: addr, Hostname: "host", ReconnectDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if sink.Stats().Errors != 1 {
+		t.Fatalf("dial error not counted %+v", sink.Stats())
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	time.Sleep(2 * time.Millisecond)
+	sink.Emit(attackEvent())
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg := readFramed(t, bufio.NewReader(c))
+	if !syslogRegexp.MatchString(msg) {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
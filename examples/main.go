@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/t1khttp"
 )
 
 func initDetect() *t1k.Server {
@@ -30,17 +31,13 @@ func main() {
 		fmt.Println("Init detect error")
 		return
 	}
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		res, err := server.DetectHttpRequest(r)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if res.Blocked() {
-			http.Error(w, fmt.Sprintf("blocked event id %s", res.EventID()), res.StatusCode())
-			return
-		}
-		_, _ = w.Write([]byte("allowed"))
+	detect := t1khttp.Middleware(server, &t1khttp.Options{
+		ErrorHook: func(r *http.Request, err error) {
+			fmt.Printf("Detect error: %s\n", err.Error())
+		},
 	})
+	http.Handle("/", detect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("allowed"))
+	})))
 	_ = http.ListenAndServe(":80", nil)
 }
@@ -0,0 +1,76 @@
+package t1k
+
+import (
+	"github.com/chaitin/t1k-go/detection"
+)
+
+// Fallback decides on requests while no healthy detector can be reached,
+// that is when the health check reports the detector down, or when getting
+// a connection or its socket fails. Errors reading the request or decoding
+// the detector answer are reported as is. Returning nil reports the error
+// as without a fallback.
+type Fallback interface {
+	FallbackRequest(dc *detection.DetectionContext) *detection.Result
+}
+
+// Deferrer keeps the requests passed without the detector inspecting
+// them, to detect them once it is back. Defer is called on the detection
+// path.
+type Deferrer interface {
+	Defer(dc *detection.DetectionContext)
+}
+
+func (s *Server) UpdateFallback(fallback Fallback) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.fallback = fallback
+}
+
+func (s *Server) UpdateDeferrer(deferrer Deferrer) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.deferrer = deferrer
+}
+
+func (s *Server) getFallback() Fallback {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.fallback
+}
+
+func (s *Server) healthCheckDown() bool {
+	s.configLock.RLock()
+	enabled := s.healthCheckEnabled
+	s.configLock.RUnlock()
+	return enabled && !s.healthCheck.IsHealth()
+}
+
+// fallbackRequest returns the fallback result of dc, or nil when there is
+// no fallback or it takes no decision.
+func (s *Server) fallbackRequest(dc *detection.DetectionContext) *detection.Result {
+	f := s.getFallback()
+	if f == nil || dc.Request == nil {
+		return nil
+	}
+	ret := f.FallbackRequest(dc)
+	if ret != nil {
+		dc.ProcessResult(ret)
+	}
+	return ret
+}
+
+// detectorDown handles a request the detector could not inspect: the
+// fallback decides on it and what it does not block is deferred.
+func (s *Server) detectorDown(dc *detection.DetectionContext) *detection.Result {
+	ret := s.fallbackRequest(dc)
+	if ret != nil && ret.Blocked() {
+		return ret
+	}
+	s.configLock.RLock()
+	d := s.deferrer
+	s.configLock.RUnlock()
+	if d != nil && dc.Request != nil {
+		d.Defer(dc)
+	}
+	return ret
+}
@@ -0,0 +1,303 @@
+// Package fallback is a minimal rule engine deciding on requests while no
+// healthy detector can be reached, see t1k.Server.UpdateFallback. Rules
+// match the method, URI, headers or the beginning of the body with a
+// substring or a regular expression, the first matching rule wins.
+package fallback
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/misc"
+)
+
+const (
+	DEFAULT_BODY_PREFIX = 8 << 10
+
+	FIELD_METHOD = "method"
+	FIELD_URI    = "uri"
+	FIELD_HEADER = "header"
+	FIELD_BODY   = "body"
+
+	MATCH_CONTAINS = "contains"
+	MATCH_REGEX    = "regex"
+
+	ACTION_BLOCK = "block"
+	ACTION_ALLOW = "allow"
+
+	maxPayload = 256
+)
+
+// Rule is one entry of the rule file. Header names the header to match,
+// the whole header block is matched when it is empty. URIs are matched
+// both as received and percent-decoded.
+type Rule struct {
+	ID         string `json:"id"`
+	Field      string `json:"field"`
+	Header     string `json:"header,omitempty"`
+	Match      string `json:"match"`
+	Pattern    string `json:"pattern"`
+	IgnoreCase bool   `json:"ignore_case,omitempty"`
+	Action     string `json:"action,omitempty"` // default block
+	StatusCode int    `json:"status_code,omitempty"`
+	AttackType string `json:"attack_type,omitempty"`
+	RiskLevel  string `json:"risk_level,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Config is the rule file:
+//
+//	{
+//	  "body_prefix": 8192,
+//	  "rules": [
+//	    {"id": "sqli-1", "field": "uri", "match": "regex",
+//	     "pattern": "union\\s+select", "ignore_case": true, "attack_type": "sqli"},
+//	    {"id": "scanner-1", "field": "header", "header": "User-Agent",
+//	     "match": "contains", "pattern": "sqlmap", "ignore_case": true}
+//	  ]
+//	}
+type Config struct {
+	BodyPrefix int64  `json:"body_prefix,omitempty"` // body bytes matched, default 8KiB
+	Rules      []Rule `json:"rules"`
+}
+
+type Engine struct {
+	bodyPrefix int64
+	rules      []Rule
+	needBody   bool
+}
+
+func (r *Rule) compile() error {
+	switch r.Field {
+	case FIELD_METHOD, FIELD_URI, FIELD_HEADER, FIELD_BODY:
+	default:
+		return fmt.Errorf("unknown field %q", r.Field)
+	}
+	switch r.Action {
+	case "":
+		r.Action = ACTION_BLOCK
+	case ACTION_BLOCK, ACTION_ALLOW:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.StatusCode == 0 {
+		r.StatusCode = http.StatusForbidden
+	}
+	if r.Pattern == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	switch r.Match {
+	case MATCH_CONTAINS:
+		if r.IgnoreCase {
+			r.Pattern = strings.ToLower(r.Pattern)
+		}
+	case MATCH_REGEX:
+		pattern := r.Pattern
+		if r.IgnoreCase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	default:
+		return fmt.Errorf("unknown match %q", r.Match)
+	}
+	return nil
+}
+
+func New(config *Config) (*Engine, error) {
+	ret := &Engine{
+		bodyPrefix: config.BodyPrefix,
+		rules:      make([]Rule, len(config.Rules)),
+	}
+	if ret.bodyPrefix <= 0 {
+		ret.bodyPrefix = DEFAULT_BODY_PREFIX
+	}
+	copy(ret.rules, config.Rules)
+	for i := range ret.rules {
+		r := &ret.rules[i]
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d %q: %w", i, r.ID, err)
+		}
+		ret.needBody = ret.needBody || r.Field == FIELD_BODY
+	}
+	return ret, nil
+}
+
+func Load(r io.Reader) (*Engine, error) {
+	var config Config
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	err := d.Decode(&config)
+	if err != nil {
+		return nil, misc.ErrorWrap(err, "decode rules")
+	}
+	return New(&config)
+}
+
+func LoadFile(path string) (*Engine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, misc.ErrorWrap(err, "")
+	}
+	defer f.Close()
+	ret, err := Load(f)
+	return ret, misc.ErrorWrapf(err, "load %s", path)
+}
+
+// match returns the matched part of value.
+func (r *Rule) match(value []byte) ([]byte, bool) {
+	if r.re != nil {
+		loc := r.re.FindIndex(value)
+		if loc == nil {
+			return nil, false
+		}
+		return value[loc[0]:loc[1]], true
+	}
+	haystack := value
+	if r.IgnoreCase {
+		haystack = bytes.ToLower(value)
+	}
+	i := bytes.Index(haystack, []byte(r.Pattern))
+	if i < 0 {
+		return nil, false
+	}
+	if len(haystack) != len(value) {
+		// lowering changed the length of some runes
+		return haystack[i : i+len(r.Pattern)], true
+	}
+	return value[i : i+len(r.Pattern)], true
+}
+
+// request is the part of a request rules look at.
+type request struct {
+	meta   *detection.RequestMeta
+	header []byte
+	body   []byte
+}
+
+func (e *Engine) read(dc *detection.DetectionContext) (*request, error) {
+	if dc.Request == nil {
+		return nil, fmt.Errorf("no request in detection context")
+	}
+	header, err := dc.Request.Header()
+	if err != nil {
+		return nil, err
+	}
+	meta, err := detection.ParseRequestHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	ret := &request{
+		meta:   meta,
+		header: header,
+	}
+	if !e.needBody {
+		return ret, nil
+	}
+	// the body stays complete for the upstream, see detection.Request
+	_, body, err := dc.Request.Body()
+	if err != nil {
+		return nil, err
+	}
+	ret.body, err = io.ReadAll(io.LimitReader(body, e.bodyPrefix))
+	body.Close()
+	if err != nil {
+		return nil, misc.ErrorWrap(err, "read body prefix")
+	}
+	return ret, nil
+}
+
+func (e *Engine) values(r *Rule, req *request) [][]byte {
+	switch r.Field {
+	case FIELD_METHOD:
+		return [][]byte{[]byte(req.meta.Method)}
+	case FIELD_URI:
+		ret := [][]byte{[]byte(req.meta.URI)}
+		if decoded, err := url.QueryUnescape(req.meta.URI); err == nil && decoded != req.meta.URI {
+			ret = append(ret, []byte(decoded))
+		}
+		return ret
+	case FIELD_BODY:
+		return [][]byte{req.body}
+	}
+	if r.Header == "" {
+		return [][]byte{req.header}
+	}
+	var ret [][]byte
+	for _, v := range req.meta.Header.Values(r.Header) {
+		ret = append(ret, []byte(v))
+	}
+	return ret
+}
+
+func (r *Rule) location() string {
+	if r.Field == FIELD_HEADER && r.Header != "" {
+		return "header:" + r.Header
+	}
+	return r.Field
+}
+
+func (r *Rule) result(payload []byte) *detection.Result {
+	ret := detection.MakeLocalResult(detection.ORIGIN_LOCAL_RULE, r.Action == ACTION_ALLOW, r.StatusCode)
+	if len(payload) > maxPayload {
+		payload = payload[:maxPayload]
+	}
+	action := "deny"
+	if r.Action == ACTION_ALLOW {
+		action = "allow"
+	}
+	ret.Alog, _ = json.Marshal(&detection.AttackEvent{
+		EventID:    misc.GenUUID(),
+		RuleID:     r.ID,
+		AttackType: r.AttackType,
+		RiskLevel:  r.RiskLevel,
+		Action:     action,
+		Location:   r.location(),
+		Payload:    string(payload),
+		Module:     "t1k-fallback",
+		Timestamp:  time.Now().Unix(),
+	})
+	return ret
+}
+
+// Match returns the first rule matching the request of dc, nil when none
+// does.
+func (e *Engine) Match(dc *detection.DetectionContext) (*Rule, []byte, error) {
+	req, err := e.read(dc)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range e.rules {
+		r := &e.rules[i]
+		for _, v := range e.values(r, req) {
+			if payload, ok := r.match(v); ok {
+				return r, payload, nil
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+// FallbackRequest implements t1k.Fallback. The result carries the rule
+// in its attack log, requests matching no rule or which can not be read
+// are passed.
+func (e *Engine) FallbackRequest(dc *detection.DetectionContext) *detection.Result {
+	r, payload, err := e.Match(dc)
+	if err != nil || r == nil {
+		return detection.MakeLocalResult(detection.ORIGIN_LOCAL_RULE, true, 0)
+	}
+	return r.result(payload)
+}
@@ -0,0 +1,131 @@
+package fallback
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/detection"
+)
+
+const rules = `{
+  "body_prefix": 16,
+  "rules": [
+    {"id": "allow-health", "field": "uri", "match": "contains", "pattern": "/healthz", "action": "allow"},
+    {"id": "sqli-1", "field": "uri", "match": "regex", "pattern": "union\\s+select", "ignore_case": true,
+     "attack_type": "sqli", "risk_level": "high"},
+    {"id": "scanner-1", "field": "header", "header": "User-Agent", "match": "contains", "pattern": "SQLMAP",
+     "ignore_case": true, "status_code": 406},
+    {"id": "body-1", "field": "body", "match": "contains", "pattern": "<script>"},
+    {"id": "method-1", "field": "method", "match": "regex", "pattern": "^TRACE$"}
+  ]
+}`
+
+func makeContext(t *testing.T, method string, target string, body string) *detection.DetectionContext {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("User-Agent", "curl/8.0")
+	dc, err := detection.MakeContextWithRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func TestEngine(t *testing.T) {
+	e, err := Load(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		dc     *detection.DetectionContext
+		ruleID string
+	}{
+		{makeContext(t, "GET", "/?q=1%20UNION%20select%201", ""), "sqli-1"},
+		{makeContext(t, "GET", "/?q=1+UNION+select+1", ""), "sqli-1"},
+		{makeContext(t, "GET", "/?q=union-select", ""), ""},
+		{makeContext(t, "GET", "/healthz?q=union%20select", ""), "allow-health"},
+		{makeContext(t, "POST", "/", "<script>alert(1)</script>"), "body-1"},
+		{makeContext(t, "POST", "/", "0123456789abcdef<script>"), ""},
+		{makeContext(t, "TRACE", "/", ""), "method-1"},
+	}
+	for i, c := range cases {
+		r, _, err := e.Match(c.dc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (r == nil && c.ruleID != "") || (r != nil && r.ID != c.ruleID) {
+			t.Fatalf("case %d: expected rule %q, got %+v", i, c.ruleID, r)
+		}
+	}
+
+	scanner := httptest.NewRequest("GET", "/", nil)
+	scanner.Header.Set("User-Agent", "sqlmap/1.7")
+	dc, _ := detection.MakeContextWithRequest(scanner)
+	ret := e.FallbackRequest(dc)
+	attack, _ := ret.AttackEvent()
+	if ret.Passed() || ret.StatusCode() != 406 || ret.Origin != detection.ORIGIN_LOCAL_RULE ||
+		attack.RuleID != "scanner-1" || attack.Location != "header:User-Agent" || attack.Payload != "sqlmap" {
+		t.Fatalf("unexpected result %+v %+v", ret, attack)
+	}
+}
+
+func TestEngineKeepsBody(t *testing.T) {
+	e, err := Load(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "0123456789abcdef-rest of the body"
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	dc, _ := detection.MakeContextWithRequest(req)
+	if ret := e.FallbackRequest(dc); !ret.Passed() {
+		t.Fatal("expect pass")
+	}
+	b, _ := io.ReadAll(req.Body)
+	if string(b) != body {
+		t.Fatalf("body not kept: %q", b)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, s := range []string{
+		`{"rules": [{"id": "x", "field": "cookie", "match": "contains", "pattern": "a"}]}`,
+		`{"rules": [{"id": "x", "field": "uri", "match": "regex", "pattern": "("}]}`,
+		`{"rules": [{"id": "x", "field": "uri", "match": "glob", "pattern": "a"}]}`,
+		`{"rules": [], "unknown": 1}`,
+	} {
+		if _, err := Load(strings.NewReader(s)); err == nil {
+			t.Fatalf("expect error for %s", s)
+		}
+	}
+}
+
+func TestServerFallback(t *testing.T) {
+	server, err := t1k.NewFromSocketFactoryWithPoolSize(func() (net.Conn, error) {
+		return nil, errors.New("detector down")
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := makeContext(t, "GET", "/?q=union%20select", "")
+	if _, err := server.DetectRequestInCtx(dc); err == nil {
+		t.Fatal("expect error without fallback")
+	}
+
+	e, err := Load(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.UpdateFallback(e)
+	ret, err := server.DetectRequestInCtx(makeContext(t, "GET", "/?q=union%20select", ""))
+	if err != nil || ret.Passed() || ret.Origin != detection.ORIGIN_LOCAL_RULE {
+		t.Fatalf("expect local block, got %+v %v", ret, err)
+	}
+	reqResult, rspResult, err := server.Detect(makeContext(t, "GET", "/", ""))
+	if err != nil || !reqResult.Passed() || rspResult != nil {
+		t.Fatalf("expect local pass, got %+v %+v %v", reqResult, rspResult, err)
+	}
+}
@@ -0,0 +1,43 @@
+package t1k
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+type nilFallback struct{}
+
+func (nilFallback) FallbackRequest(dc *detection.DetectionContext) *detection.Result {
+	return nil
+}
+
+func TestDetectorDownWithoutDecision(t *testing.T) {
+	server, err := NewFromSocketFactoryWithPoolSize(func() (net.Conn, error) {
+		t.Fatal("detector dialed while down")
+		return nil, nil
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.UpdateFallback(nilFallback{})
+	server.healthCheckEnabled = true
+	server.healthCheck.healthCheckConfig = &HealthCheckConfig{UnhealthThreshold: 3}
+	server.healthCheck.Stats.ErrorCount = -5
+
+	dc, err := detection.MakeContextWithRequest(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := server.DetectRequestInCtx(dc)
+	if ret != nil || !errors.Is(err, ErrDetectorDown) {
+		t.Fatalf("expect ErrDetectorDown, got %+v %v", ret, err)
+	}
+	reqResult, _, err := server.Detect(dc)
+	if reqResult != nil || !errors.Is(err, ErrDetectorDown) {
+		t.Fatalf("expect ErrDetectorDown, got %+v %v", reqResult, err)
+	}
+}
@@ -0,0 +1,31 @@
+package t1k
+
+import (
+	"github.com/chaitin/t1k-go/detection"
+)
+
+// RequestFilter decides on a request locally, before it is sent to the
+// detector. Returning nil hands the request over to the next filter and
+// finally to the detector.
+type RequestFilter interface {
+	FilterRequest(dc *detection.DetectionContext) *detection.Result
+}
+
+func (s *Server) UpdateRequestFilters(filters ...RequestFilter) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.filters = filters
+}
+
+func (s *Server) filterRequest(dc *detection.DetectionContext) *detection.Result {
+	s.configLock.RLock()
+	filters := s.filters
+	s.configLock.RUnlock()
+	for _, f := range filters {
+		if ret := f.FilterRequest(dc); ret != nil {
+			dc.ProcessResult(ret)
+			return ret
+		}
+	}
+	return nil
+}
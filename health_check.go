@@ -36,6 +36,10 @@ const (
 
 // IsHealth return  health check result
 func (hcs *HealthCheckService) IsHealth() bool {
+	// not configured yet
+	if hcs.healthCheckConfig == nil {
+		return true
+	}
 	if hcs.Stats.ErrorCount > hcs.healthCheckConfig.UnhealthThreshold {
 		return false
 	}
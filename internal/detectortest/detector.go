@@ -0,0 +1,122 @@
+// Package detectortest provides an in-memory T1K detector for tests.
+package detectortest
+
+import (
+	"bytes"
+	"net"
+
+	t1kgo "github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/t1k"
+)
+
+type Reply struct {
+	Head     byte
+	Sections []t1k.Section
+	// Raw, when set, is written as is instead of the reply, e.g. to send a
+	// malformed one.
+	Raw []byte
+}
+
+func Pass() *Reply {
+	return &Reply{Head: '.'}
+}
+
+func Block(statusCode string, eventID string) *Reply {
+	return &Reply{
+		Head: '?',
+		Sections: []t1k.Section{
+			t1k.MakeSimpleSection(t1k.TAG_BODY, []byte(statusCode)),
+			t1k.MakeSimpleSection(t1k.TAG_EXTRA_BODY, []byte("<!-- event_id: "+eventID+" -->")),
+		},
+	}
+}
+
+// Detector answers every message with the Reply of Decide, which gets the
+// received sections keyed by stripped tag. Heartbeats are always passed.
+type Detector struct {
+	Decide func(sections map[t1k.Tag][]byte) *Reply
+}
+
+// pipeConn skips empty writes, which block on a net.Pipe until the peer
+// reads while they are no-ops on a real socket.
+type pipeConn struct {
+	net.Conn
+}
+
+func (c pipeConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (d *Detector) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	go d.serve(server)
+	return pipeConn{client}, nil
+}
+
+func (d *Detector) NewServer() (*t1kgo.Server, error) {
+	return t1kgo.NewFromSocketFactoryWithPoolSize(d.Dial, 1)
+}
+
+func (d *Detector) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		sections := make(map[t1k.Tag][]byte)
+		for {
+			sec, err := t1k.ReadSplitSection(c)
+			if err != nil {
+				return
+			}
+			var buf bytes.Buffer
+			if err := sec.WriteBody(&buf); err != nil {
+				return
+			}
+			if sec.Tag().Strip() != 0 {
+				sections[sec.Tag().Strip()] = buf.Bytes()
+			}
+			if sec.Tag().IsLast() {
+				break
+			}
+		}
+		reply := Pass()
+		if len(sections) > 0 && d.Decide != nil {
+			reply = d.Decide(sections)
+		}
+		if err := writeReply(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+func writeReply(c net.Conn, reply *Reply) error {
+	if reply.Raw != nil {
+		_, err := c.Write(reply.Raw)
+		return err
+	}
+	headTag := t1k.TAG_HEADER | t1k.MASK_FIRST
+	if len(reply.Sections) == 0 {
+		headTag |= t1k.MASK_LAST
+	}
+	var buf bytes.Buffer
+	err := t1k.WriteSection(t1k.MakeSimpleSection(headTag, []byte{reply.Head}), &buf)
+	if err != nil {
+		return err
+	}
+	for i, sec := range reply.Sections {
+		var body bytes.Buffer
+		if err := sec.WriteBody(&body); err != nil {
+			return err
+		}
+		tag := sec.Header().Tag
+		if i == len(reply.Sections)-1 {
+			tag |= t1k.MASK_LAST
+		}
+		if err := t1k.WriteSection(t1k.MakeSimpleSection(tag, body.Bytes()), &buf); err != nil {
+			return err
+		}
+	}
+	_, err = c.Write(buf.Bytes())
+	return err
+}
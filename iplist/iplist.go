@@ -0,0 +1,247 @@
+package iplist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+
+	"github.com/chaitin/t1k-go/misc"
+)
+
+type Action int
+
+const (
+	ACTION_NONE  Action = 0
+	ACTION_ALLOW Action = 1
+	ACTION_DENY  Action = 2
+)
+
+func (a Action) String() string {
+	switch a {
+	case ACTION_ALLOW:
+		return "allow"
+	case ACTION_DENY:
+		return "deny"
+	}
+	return "none"
+}
+
+// List is an allow/deny list matched against DetectionContext.RemoteAddr.
+// Allowed addresses are passed without detection, denied addresses are
+// blocked locally. The allow list takes precedence over the deny list.
+type List struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	DenyStatusCode int
+	ErrorHook      func(error)
+
+	lock    sync.RWMutex
+	closeCh chan struct{}
+	once    sync.Once
+}
+
+func New() *List {
+	return &List{
+		DenyStatusCode: http.StatusForbidden,
+		closeCh:        make(chan struct{}),
+	}
+}
+
+// parseCIDR accepts both CIDR notation and plain addresses, which are
+// treated as a single host.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		ipNet, err := parseCIDR(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ipNet)
+	}
+	return ret, nil
+}
+
+// Update replaces both lists atomically. On error the current lists are kept.
+func (l *List) Update(allow []string, deny []string) error {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return misc.ErrorWrap(err, "parse allow list")
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return misc.ErrorWrap(err, "parse deny list")
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.allow = allowNets
+	l.deny = denyNets
+	return nil
+}
+
+// Load reads a list in the following format, one entry per line:
+//
+//	# comment
+//	allow 10.0.0.0/8
+//	deny 2001:db8::/32
+//	deny 203.0.113.7
+func (l *List) Load(r io.Reader) error {
+	var allow, deny []string
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expect `allow|deny <cidr>`, got %q", lineNo, line)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			allow = append(allow, fields[1])
+		case "deny":
+			deny = append(deny, fields[1])
+		default:
+			return fmt.Errorf("line %d: unknown action %q", lineNo, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return misc.ErrorWrap(err, "")
+	}
+	return l.Update(allow, deny)
+}
+
+func (l *List) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return misc.ErrorWrap(err, "")
+	}
+	defer f.Close()
+	return misc.ErrorWrapf(l.Load(f), "load %s", path)
+}
+
+// WatchFile loads path and then polls it every interval, reloading it
+// when its modification time or size changes. Reload errors are passed
+// to ErrorHook and the previously loaded lists stay in effect.
+func (l *List) WatchFile(path string, interval time.Duration) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return misc.ErrorWrap(err, "")
+	}
+	err = l.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	go l.runWatchCo(path, interval, info)
+	return nil
+}
+
+func (l *List) runWatchCo(path string, interval time.Duration, last os.FileInfo) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.closeCh:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			l.onErr(err)
+			continue
+		}
+		if info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		l.onErr(l.LoadFile(path))
+	}
+}
+
+func (l *List) onErr(err error) {
+	if err != nil && l.ErrorHook != nil {
+		l.ErrorHook(err)
+	}
+}
+
+// Close stops watching the file, if any.
+func (l *List) Close() {
+	l.once.Do(func() {
+		close(l.closeCh)
+	})
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRemoteAddr(addr string) net.IP {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	return ip
+}
+
+func (l *List) Lookup(addr string) Action {
+	ip := parseRemoteAddr(addr)
+	if ip == nil {
+		return ACTION_NONE
+	}
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if contains(l.allow, ip) {
+		return ACTION_ALLOW
+	}
+	if contains(l.deny, ip) {
+		return ACTION_DENY
+	}
+	return ACTION_NONE
+}
+
+// FilterRequest implements t1k.RequestFilter.
+func (l *List) FilterRequest(dc *detection.DetectionContext) *detection.Result {
+	switch l.Lookup(dc.RemoteAddr) {
+	case ACTION_ALLOW:
+		return detection.MakeLocalResult(detection.ORIGIN_IP_LIST, true, 0)
+	case ACTION_DENY:
+		return detection.MakeLocalResult(detection.ORIGIN_IP_LIST, false, l.DenyStatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package iplist
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+func TestLookup(t *testing.T) {
+	l := New()
+	err := l.Load(strings.NewReader(
+		"# internal scanners\n" +
+			"allow 10.0.0.0/8\n" +
+			"allow 2001:db8:1::/48\n" +
+			"deny 0.0.0.0/0\n" +
+			"deny 2001:db8::/32\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]Action{
+		"10.1.2.3":         ACTION_ALLOW,
+		"10.1.2.3:4567":    ACTION_ALLOW,
+		"203.0.113.7":      ACTION_DENY,
+		"2001:db8:1::1":    ACTION_ALLOW,
+		"[2001:db8::1]:80": ACTION_DENY,
+		"2001:db9::1":      ACTION_NONE,
+		"not-an-ip":        ACTION_NONE,
+	}
+	for addr, expect := range cases {
+		if got := l.Lookup(addr); got != expect {
+			t.Errorf("Lookup(%s) = %s, expect %s", addr, got, expect)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	l := New()
+	if err := l.Update([]string{"10.0.0.1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Load(strings.NewReader("deny 10.0.0.0/33\n")); err == nil {
+		t.Fatal("expect error for invalid cidr")
+	}
+	if l.Lookup("10.0.0.1") != ACTION_ALLOW {
+		t.Fatal("previous list should be kept on error")
+	}
+}
+
+func TestFilterRequest(t *testing.T) {
+	l := New()
+	if err := l.Update([]string{"127.0.0.1"}, []string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	dc := detection.New()
+	ret := l.FilterRequest(dc)
+	if ret == nil || !ret.Passed() || ret.Origin != detection.ORIGIN_IP_LIST {
+		t.Fatalf("expect local pass, got %+v", ret)
+	}
+	dc.RemoteAddr = "192.0.2.10"
+	ret = l.FilterRequest(dc)
+	if ret == nil || !ret.Blocked() || ret.StatusCode() != 403 {
+		t.Fatalf("expect local block, got %+v", ret)
+	}
+	dc.RemoteAddr = "198.51.100.1"
+	if ret = l.FilterRequest(dc); ret != nil {
+		t.Fatalf("expect no decision, got %+v", ret)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iplist.txt")
+	if err := os.WriteFile(path, []byte("deny 192.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := New()
+	defer l.Close()
+	if err := l.WatchFile(path, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if l.Lookup("192.0.2.1") != ACTION_DENY {
+		t.Fatal("expect deny after initial load")
+	}
+	if err := os.WriteFile(path, []byte("allow 192.0.2.1/32\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for l.Lookup("192.0.2.1") != ACTION_ALLOW {
+		if time.Now().After(deadline) {
+			t.Fatal("file change not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,208 @@
+// Package ratelimit limits the requests of each client with token
+// buckets, before they take a detector connection. A Limiter is a
+// t1k.RequestFilter, requests over the limit get a synthetic 429 result
+// which is rendered and reported like any other block.
+package ratelimit
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+const (
+	DEFAULT_MAX_KEYS = 100000
+)
+
+// KeyFunc returns the key requests are counted by, an empty key is not
+// limited.
+type KeyFunc func(dc *detection.DetectionContext) string
+
+// ClientIP is the default KeyFunc.
+func ClientIP(dc *detection.DetectionContext) string {
+	if ip := net.ParseIP(dc.RemoteAddr); ip != nil {
+		return ip.String()
+	}
+	if host, _, err := net.SplitHostPort(dc.RemoteAddr); err == nil {
+		return host
+	}
+	return dc.RemoteAddr
+}
+
+// Route is the limit of the requests it matches. Empty conditions match
+// everything, a route without condition is the default one.
+type Route struct {
+	Host       string
+	Method     string
+	PathPrefix string
+	Burst      int     // bucket size
+	Rate       float64 // tokens refilled per second
+}
+
+func (r *Route) needMeta() bool {
+	return r.Host != "" || r.Method != "" || r.PathPrefix != ""
+}
+
+func (r *Route) match(meta *detection.RequestMeta) bool {
+	if !r.needMeta() {
+		return true
+	}
+	if meta == nil {
+		return false
+	}
+	if r.Host != "" && !strings.EqualFold(r.Host, meta.Host) {
+		return false
+	}
+	if r.Method != "" && !strings.EqualFold(r.Method, meta.Method) {
+		return false
+	}
+	return strings.HasPrefix(meta.Path, r.PathPrefix)
+}
+
+type Config struct {
+	Routes  []Route // the first matching route applies
+	Key     KeyFunc // default ClientIP
+	MaxKeys int     // buckets kept, the least recently used are evicted
+}
+
+type bucketKey struct {
+	route int
+	key   string
+}
+
+type bucket struct {
+	key    bucketKey
+	tokens float64
+	last   time.Time
+}
+
+type Limiter struct {
+	routes   []Route
+	key      KeyFunc
+	maxKeys  int
+	needMeta bool
+
+	lock    sync.Mutex
+	lru     *list.List // of *bucket, most recently used first
+	buckets map[bucketKey]*list.Element
+	now     func() time.Time
+}
+
+func New(config *Config) (*Limiter, error) {
+	if len(config.Routes) == 0 {
+		return nil, errors.New("no rate limit route")
+	}
+	ret := &Limiter{
+		routes:  config.Routes,
+		key:     config.Key,
+		maxKeys: config.MaxKeys,
+		lru:     list.New(),
+		buckets: make(map[bucketKey]*list.Element),
+		now:     time.Now,
+	}
+	for i, r := range ret.routes {
+		if r.Burst <= 0 || r.Rate < 0 {
+			return nil, fmt.Errorf("route %d: invalid burst %d or rate %v", i, r.Burst, r.Rate)
+		}
+		ret.needMeta = ret.needMeta || r.needMeta()
+	}
+	if ret.key == nil {
+		ret.key = ClientIP
+	}
+	if ret.maxKeys <= 0 {
+		ret.maxKeys = DEFAULT_MAX_KEYS
+	}
+	return ret, nil
+}
+
+func (l *Limiter) route(dc *detection.DetectionContext) int {
+	var meta *detection.RequestMeta
+	if l.needMeta {
+		meta, _ = dc.RequestMeta()
+	}
+	for i := range l.routes {
+		if l.routes[i].match(meta) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *Limiter) get(k bucketKey, now time.Time) *bucket {
+	if e, ok := l.buckets[k]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*bucket)
+	}
+	if l.lru.Len() >= l.maxKeys {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*bucket).key)
+	}
+	b := &bucket{
+		key:    k,
+		tokens: float64(l.routes[k.route].Burst),
+		last:   now,
+	}
+	l.buckets[k] = l.lru.PushFront(b)
+	return b
+}
+
+// Allow takes a token for the request and returns whether there was one,
+// otherwise how long until the next one.
+func (l *Limiter) Allow(dc *detection.DetectionContext) (bool, time.Duration) {
+	key := l.key(dc)
+	if key == "" {
+		return true, 0
+	}
+	i := l.route(dc)
+	if i < 0 {
+		return true, 0
+	}
+	r := &l.routes[i]
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	b := l.get(bucketKey{i, key}, now)
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(r.Burst), b.tokens+elapsed.Seconds()*r.Rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if r.Rate == 0 {
+		return false, 0
+	}
+	return false, time.Duration((1 - b.tokens) / r.Rate * float64(time.Second))
+}
+
+// FilterRequest implements t1k.RequestFilter, a limited request gets a
+// 429 result with a Retry-After header.
+func (l *Limiter) FilterRequest(dc *detection.DetectionContext) *detection.Result {
+	ok, wait := l.Allow(dc)
+	if ok {
+		return nil
+	}
+	ret := detection.MakeLocalResult(detection.ORIGIN_RATE_LIMIT, false, http.StatusTooManyRequests)
+	if wait > 0 {
+		ret.ExtraHeader = []byte(fmt.Sprintf("Retry-After: %d\n", int64(math.Ceil(wait.Seconds()))))
+	}
+	return ret
+}
+
+// Len is the number of buckets kept.
+func (l *Limiter) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.lru.Len()
+}
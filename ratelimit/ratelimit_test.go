@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/internal/detectortest"
+	"github.com/chaitin/t1k-go/t1k"
+	"github.com/chaitin/t1k-go/t1khttp"
+)
+
+func makeContext(t *testing.T, method string, target string, remoteAddr string) *detection.DetectionContext {
+	req := httptest.NewRequest(method, target, nil)
+	req.RemoteAddr = remoteAddr
+	dc, err := detection.MakeContextWithRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func TestLimiterRoutes(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l, err := New(&Config{Routes: []Route{
+		{Method: "POST", PathPrefix: "/login", Burst: 2, Rate: 0.5},
+		{Burst: 100, Rate: 100},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return now }
+
+	login := makeContext(t, "POST", "http://a.com/login", "192.0.2.1:1234")
+	for i := 0; i < 2; i++ {
+		if ret := l.FilterRequest(login); ret != nil {
+			t.Fatalf("request %d limited", i)
+		}
+	}
+	ret := l.FilterRequest(login)
+	if ret == nil || ret.Origin != detection.ORIGIN_RATE_LIMIT || ret.StatusCode() != http.StatusTooManyRequests {
+		t.Fatalf("expect 429, got %+v", ret)
+	}
+	if h, _ := ret.ParseExtraHeader(); h.Get("Retry-After") != "2" {
+		t.Fatalf("unexpected retry after %v", h)
+	}
+
+	// other routes and clients have their own buckets
+	if l.FilterRequest(makeContext(t, "GET", "http://a.com/login", "192.0.2.1:1234")) != nil {
+		t.Fatal("default route limited")
+	}
+	if l.FilterRequest(makeContext(t, "POST", "http://a.com/login", "192.0.2.2:1234")) != nil {
+		t.Fatal("other client limited")
+	}
+
+	now = now.Add(2 * time.Second)
+	if l.FilterRequest(login) != nil {
+		t.Fatal("token not refilled")
+	}
+	if l.FilterRequest(login) == nil {
+		t.Fatal("refilled more than the rate")
+	}
+}
+
+func TestLimiterLRU(t *testing.T) {
+	l, err := New(&Config{Routes: []Route{{Burst: 1}}, MaxKeys: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := makeContext(t, "GET", "/", "192.0.2.1:1")
+	l.FilterRequest(a)
+	l.FilterRequest(makeContext(t, "GET", "/", "192.0.2.2:1"))
+	l.FilterRequest(makeContext(t, "GET", "/", "192.0.2.3:1"))
+	if l.Len() != 2 {
+		t.Fatalf("expected 2 buckets, got %d", l.Len())
+	}
+	// the bucket of a was evicted, it starts full again
+	if l.FilterRequest(a) != nil {
+		t.Fatal("evicted bucket kept")
+	}
+}
+
+func TestLimiterMiddleware(t *testing.T) {
+	d := &detectortest.Detector{
+		Decide: func(sections map[t1k.Tag][]byte) *detectortest.Reply {
+			return detectortest.Pass()
+		},
+	}
+	server, err := d.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := New(&Config{Routes: []Route{{Burst: 1, Rate: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.UpdateRequestFilters(l)
+	h := t1khttp.Middleware(server, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	codes := []int{}
+	var last *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		last = httptest.NewRecorder()
+		h.ServeHTTP(last, httptest.NewRequest("GET", "/", nil))
+		codes = append(codes, last.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || last.Header().Get("Retry-After") != "1" {
+		t.Fatalf("unexpected codes %v, headers %v", codes, last.Header())
+	}
+}
@@ -0,0 +1,293 @@
+// Package replay inspects the requests passed while the detector was
+// down, once it is back. A Queue is a t1k.Deferrer: it snapshots the
+// requests the Server could not detect and replays them through
+// Server.DetectRequest when the health check reports the detector healthy
+// again. The verdicts reach the event sinks of the Server with the
+// replayed flag set, it is too late to block anything.
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/misc"
+)
+
+const (
+	DEFAULT_MAX_ITEMS = 10000
+	DEFAULT_MAX_BODY  = 64 << 10
+	DEFAULT_INTERVAL  = time.Second
+
+	snapshotSuffix = ".json"
+)
+
+type Config struct {
+	Server   *t1k.Server
+	MaxItems int   // snapshots kept, newer ones are dropped, default 10000
+	MaxBody  int64 // body bytes kept per snapshot, default 64KiB
+	// snapshots are persisted in Dir when set and loaded again by New;
+	// they are written every Interval, a crash loses at most that much
+	Dir       string
+	Interval  time.Duration // default 1s
+	ErrorHook func(error)
+}
+
+type Stats struct {
+	Queued   int
+	Captured uint64
+	Dropped  uint64 // as the queue was full, the snapshot failed or its replay did
+	Replayed uint64
+	Blocked  uint64 // replayed requests the detector blocked
+}
+
+type Queue struct {
+	// accessed atomically, kept first for alignment
+	captured uint64
+	dropped  uint64
+	replayed uint64
+	blocked  uint64
+
+	config *Config
+
+	lock  sync.Mutex
+	items []*Snapshot
+
+	// serializes replays and persistence, which both use Snapshot.path
+	ioLock sync.Mutex
+
+	closeCh chan struct{}
+	doneCh  chan struct{}
+	once    sync.Once
+}
+
+func New(config *Config) (*Queue, error) {
+	if config.Server == nil {
+		return nil, fmt.Errorf("no server to replay to")
+	}
+	c := *config
+	if c.MaxItems <= 0 {
+		c.MaxItems = DEFAULT_MAX_ITEMS
+	}
+	if c.MaxBody <= 0 {
+		c.MaxBody = DEFAULT_MAX_BODY
+	}
+	if c.Interval <= 0 {
+		c.Interval = DEFAULT_INTERVAL
+	}
+	ret := &Queue{
+		config:  &c,
+		closeCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	if c.Dir != "" {
+		if err := ret.load(); err != nil {
+			return nil, err
+		}
+	}
+	go ret.run()
+	return ret, nil
+}
+
+func (q *Queue) onErr(err error) {
+	if err != nil && q.config.ErrorHook != nil {
+		q.config.ErrorHook(err)
+	}
+}
+
+// Defer implements t1k.Deferrer.
+func (q *Queue) Defer(dc *detection.DetectionContext) {
+	if dc.Deferred {
+		return
+	}
+	s, err := Capture(dc, q.config.MaxBody)
+	if err != nil {
+		atomic.AddUint64(&q.dropped, 1)
+		q.onErr(err)
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.items) >= q.config.MaxItems {
+		atomic.AddUint64(&q.dropped, 1)
+		return
+	}
+	q.items = append(q.items, s)
+	atomic.AddUint64(&q.captured, 1)
+}
+
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+func (q *Queue) Stats() Stats {
+	return Stats{
+		Queued:   q.Len(),
+		Captured: atomic.LoadUint64(&q.captured),
+		Dropped:  atomic.LoadUint64(&q.dropped),
+		Replayed: atomic.LoadUint64(&q.replayed),
+		Blocked:  atomic.LoadUint64(&q.blocked),
+	}
+}
+
+func (q *Queue) pop() *Snapshot {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	ret := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return ret
+}
+
+func (q *Queue) pushFront(s *Snapshot) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.items = append([]*Snapshot{s}, q.items...)
+}
+
+// Replay detects the queued snapshots in order. It stops at the first
+// connection failure and keeps the snapshot for the next try, snapshots
+// failing otherwise are dropped and reported to ErrorHook.
+func (q *Queue) Replay() error {
+	q.ioLock.Lock()
+	defer q.ioLock.Unlock()
+	for {
+		s := q.pop()
+		if s == nil {
+			return nil
+		}
+		dc := s.Context()
+		ret, err := q.config.Server.DetectRequest(dc.Request)
+		if t1k.IsConnError(err) {
+			q.pushFront(s)
+			return err
+		}
+		if err != nil {
+			q.onErr(misc.ErrorWrapf(err, "replay %s", s.UUID))
+			atomic.AddUint64(&q.dropped, 1)
+		} else {
+			atomic.AddUint64(&q.replayed, 1)
+			if ret.Blocked() {
+				atomic.AddUint64(&q.blocked, 1)
+			}
+		}
+		if s.path != "" {
+			q.onErr(misc.ErrorWrap(os.Remove(s.path), ""))
+		}
+	}
+}
+
+func (q *Queue) load() error {
+	err := os.MkdirAll(q.config.Dir, 0755)
+	if err != nil {
+		return misc.ErrorWrap(err, "")
+	}
+	paths, err := filepath.Glob(filepath.Join(q.config.Dir, "*"+snapshotSuffix))
+	if err != nil {
+		return misc.ErrorWrap(err, "")
+	}
+	// names start with the capture time
+	sort.Strings(paths)
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			q.onErr(misc.ErrorWrap(err, ""))
+			continue
+		}
+		s := &Snapshot{}
+		if err := json.Unmarshal(b, s); err != nil || len(q.items) >= q.config.MaxItems {
+			q.onErr(misc.ErrorWrapf(err, "load %s", path))
+			atomic.AddUint64(&q.dropped, 1)
+			os.Remove(path)
+			continue
+		}
+		s.path = path
+		q.items = append(q.items, s)
+	}
+	return nil
+}
+
+func (q *Queue) persist(s *Snapshot) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return misc.ErrorWrap(err, "")
+	}
+	name := fmt.Sprintf("%020d-%s%s", s.Time.UnixNano(), strings.ReplaceAll(s.UUID, "/", "_"), snapshotSuffix)
+	path := filepath.Join(q.config.Dir, name)
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return misc.ErrorWrap(err, "")
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return misc.ErrorWrap(err, "")
+	}
+	s.path = path
+	return nil
+}
+
+// persistAll writes the snapshots not persisted yet.
+func (q *Queue) persistAll() {
+	if q.config.Dir == "" {
+		return
+	}
+	q.ioLock.Lock()
+	defer q.ioLock.Unlock()
+	q.lock.Lock()
+	var pending []*Snapshot
+	for _, s := range q.items {
+		if s.path == "" {
+			pending = append(pending, s)
+		}
+	}
+	q.lock.Unlock()
+	for _, s := range pending {
+		if err := q.persist(s); err != nil {
+			q.onErr(err)
+			return
+		}
+	}
+}
+
+func (q *Queue) run() {
+	defer close(q.doneCh)
+	ticker := time.NewTicker(q.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.closeCh:
+			q.persistAll()
+			return
+		case <-ticker.C:
+		}
+		q.persistAll()
+		if q.Len() == 0 || !q.config.Server.IsHealth() {
+			continue
+		}
+		// failures are expected while the detector comes back
+		_ = q.Replay()
+	}
+}
+
+// Close stops replaying and persists the queued snapshots, if Dir is set.
+func (q *Queue) Close() {
+	q.once.Do(func() {
+		close(q.closeCh)
+	})
+	<-q.doneCh
+}
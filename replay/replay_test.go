@@ -0,0 +1,188 @@
+package replay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/event"
+	"github.com/chaitin/t1k-go/internal/detectortest"
+	t1kproto "github.com/chaitin/t1k-go/t1k"
+)
+
+type memorySink struct {
+	lock   sync.Mutex
+	events []*event.Event
+}
+
+func (s *memorySink) Emit(e *event.Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, e)
+}
+
+// newFlakyServer returns a server whose detector is reachable only when
+// up is set, it blocks bodies containing "attack" and answers those
+// containing "malformed" with a section not marked first.
+func newFlakyServer(t *testing.T, up *int32) *t1k.Server {
+	d := &detectortest.Detector{
+		Decide: func(sections map[t1kproto.Tag][]byte) *detectortest.Reply {
+			if bytes.Contains(sections[t1kproto.TAG_BODY], []byte("malformed")) {
+				return &detectortest.Reply{Raw: []byte{byte(t1kproto.TAG_HEADER), 1, 0, 0, 0, '.'}}
+			}
+			if bytes.Contains(sections[t1kproto.TAG_BODY], []byte("attack")) {
+				return detectortest.Block("403", "late")
+			}
+			return detectortest.Pass()
+		},
+	}
+	server, err := t1k.NewFromSocketFactoryWithPoolSize(func() (net.Conn, error) {
+		if atomic.LoadInt32(up) == 0 {
+			return nil, errors.New("detector down")
+		}
+		return d.Dial()
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func makeContext(t *testing.T, body string) *detection.DetectionContext {
+	req := httptest.NewRequest("POST", "http://a.com/form", strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:4321"
+	dc, err := detection.MakeContextWithRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func TestQueueReplay(t *testing.T) {
+	var up int32
+	server := newFlakyServer(t, &up)
+	sink := &memorySink{}
+	server.UpdateEventSinks(sink)
+	q, err := New(&Config{Server: server, Interval: time.Hour, MaxBody: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	server.UpdateDeferrer(q)
+
+	for _, body := range []string{"hello", "an attack"} {
+		if _, err := server.DetectRequestInCtx(makeContext(t, body)); err == nil {
+			t.Fatal("expect error while down")
+		}
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 deferred, got %d", q.Len())
+	}
+	if err := q.Replay(); err == nil || q.Len() != 2 {
+		t.Fatalf("replayed while down: %v", err)
+	}
+
+	atomic.StoreInt32(&up, 1)
+	if err := q.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := q.Stats(); stats.Queued != 0 || stats.Replayed != 2 || stats.Blocked != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(sink.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(sink.events))
+	}
+	e := sink.events[1].Decode()
+	if !e.Blocked() || !e.Replayed || e.RemoteAddr != "192.0.2.1" || e.URI != "/form" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestQueueReplayDropsFailures(t *testing.T) {
+	up := int32(1)
+	server := newFlakyServer(t, &up)
+	var errs int32
+	q, err := New(&Config{Server: server, Interval: time.Hour, ErrorHook: func(error) {
+		atomic.AddInt32(&errs, 1)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// a snapshot the detector can not answer does not hold the queue up
+	q.Defer(makeContext(t, "malformed"))
+	q.Defer(makeContext(t, "hello"))
+	if err := q.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := q.Stats(); stats.Queued != 0 || stats.Dropped != 1 || stats.Replayed != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if atomic.LoadInt32(&errs) != 1 {
+		t.Fatalf("expected the failure reported once, got %d", errs)
+	}
+}
+
+func TestQueuePersist(t *testing.T) {
+	var up int32
+	server := newFlakyServer(t, &up)
+	dir := t.TempDir()
+	q, err := New(&Config{Server: server, Dir: dir, Interval: time.Hour, MaxItems: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Defer(makeContext(t, "first"))
+	q.Defer(makeContext(t, "second"))
+	q.Close()
+	if stats := q.Stats(); stats.Captured != 1 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	q, err = New(&Config{Server: server, Dir: dir, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Len() != 1 || string(q.items[0].Body) != "first" {
+		t.Fatalf("snapshot not loaded")
+	}
+	atomic.StoreInt32(&up, 1)
+	if err := q.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if q2, _ := New(&Config{Server: server, Dir: dir, Interval: time.Hour}); q2.Len() != 0 {
+		t.Fatal("replayed snapshot not removed")
+	}
+}
+
+func TestCaptureDecodedBody(t *testing.T) {
+	var encoded bytes.Buffer
+	zw := gzip.NewWriter(&encoded)
+	zw.Write([]byte("q=attack"))
+	zw.Close()
+	req := httptest.NewRequest("POST", "http://a.com/form", bytes.NewReader(encoded.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	dc, err := detection.MakeContextWithRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.DecodeBody = true
+
+	snapshot, err := Capture(dc, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(snapshot.Body) != "q=attack" || strings.Contains(string(snapshot.Header), "Content-Encoding") {
+		t.Fatalf("header does not describe the body: %q %q", snapshot.Header, snapshot.Body)
+	}
+}
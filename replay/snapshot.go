@@ -0,0 +1,115 @@
+package replay
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/misc"
+)
+
+// Snapshot is what is needed to detect a request again, after it was
+// handled. Only the first bytes of the body are kept.
+type Snapshot struct {
+	Time         time.Time `json:"time"`
+	UUID         string    `json:"uuid"`
+	Scheme       string    `json:"scheme"`
+	ProxyName    string    `json:"proxy_name"`
+	RemoteAddr   string    `json:"remote_addr"`
+	RemotePort   uint16    `json:"remote_port"`
+	LocalAddr    string    `json:"local_addr"`
+	LocalPort    uint16    `json:"local_port"`
+	Protocol     string    `json:"protocol"`
+	ReqBeginTime int64     `json:"req_begin_time"`
+	UserData     []byte    `json:"user_data,omitempty"`
+
+	Header    []byte `json:"header"`
+	Body      []byte `json:"body,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+
+	// file the snapshot is persisted in, if any
+	path string
+}
+
+// Capture snapshots the request of dc. The body is read through
+// dc.Request, which keeps it complete for the upstream.
+func Capture(dc *detection.DetectionContext, maxBody int64) (*Snapshot, error) {
+	header, err := dc.Request.Header()
+	if err != nil {
+		return nil, err
+	}
+	ret := &Snapshot{
+		Time:         time.Now(),
+		UUID:         dc.UUID,
+		Scheme:       dc.Scheme,
+		ProxyName:    dc.ProxyName,
+		RemoteAddr:   dc.RemoteAddr,
+		RemotePort:   dc.RemotePort,
+		LocalAddr:    dc.LocalAddr,
+		LocalPort:    dc.LocalPort,
+		Protocol:     dc.Protocol,
+		ReqBeginTime: dc.ReqBeginTime,
+		UserData:     dc.UserData,
+		Header:       header,
+	}
+	size, body, err := detection.BodyOf(dc.Request)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	ret.Body, err = io.ReadAll(io.LimitReader(body, maxBody))
+	if err != nil {
+		return nil, misc.ErrorWrap(err, "read body")
+	}
+	ret.Truncated = size > int64(len(ret.Body))
+	return ret, nil
+}
+
+// Context rebuilds a detection context of the snapshot.
+func (s *Snapshot) Context() *detection.DetectionContext {
+	dc := &detection.DetectionContext{
+		UUID:         s.UUID,
+		Scheme:       s.Scheme,
+		ProxyName:    s.ProxyName,
+		RemoteAddr:   s.RemoteAddr,
+		RemotePort:   s.RemotePort,
+		LocalAddr:    s.LocalAddr,
+		LocalPort:    s.LocalPort,
+		Protocol:     s.Protocol,
+		ReqBeginTime: s.ReqBeginTime,
+		UserData:     s.UserData,
+		Deferred:     true,
+	}
+	dc.Request = &request{
+		snapshot: s,
+		dc:       dc,
+	}
+	return dc
+}
+
+// request implements detection.Request over a Snapshot.
+type request struct {
+	snapshot *Snapshot
+	dc       *detection.DetectionContext
+}
+
+func (r *request) Header() ([]byte, error) {
+	return r.snapshot.Header, nil
+}
+
+func (r *request) Body() (uint32, io.ReadCloser, error) {
+	return uint32(len(r.snapshot.Body)), io.NopCloser(bytes.NewReader(r.snapshot.Body)), nil
+}
+
+func (r *request) Extra() ([]byte, error) {
+	return detection.AppendTruncatedExtra(detection.GenRequestExtra(r.dc), r.snapshot.Truncated), nil
+}
+
+func (r *request) UserData() ([]byte, error) {
+	return r.snapshot.UserData, nil
+}
+
+func (r *request) DetectionContext() *detection.DetectionContext {
+	return r.dc
+}
@@ -1,6 +1,7 @@
 package t1k
 
 import (
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/event"
 
 	"github.com/chaitin/t1k-go/misc"
 )
@@ -20,6 +22,10 @@ const (
 	HEARTBEAT_INTERVAL = 20
 )
 
+// ErrDetectorDown is returned when the health check reports the detector
+// down and the fallback takes no decision.
+var ErrDetectorDown = errors.New("detector down")
+
 type Server struct {
 	socketFactory   func() (net.Conn, error)
 	poolCh          chan *conn
@@ -33,6 +39,13 @@ type Server struct {
 	configLock sync.RWMutex
 
 	healthCheck *HealthCheckService
+	filters     []RequestFilter
+	decoder     *ResultDecoder
+	sinks       []event.Sink
+	fallback    Fallback
+	deferrer    Deferrer
+
+	healthCheckEnabled bool
 }
 
 func (s *Server) UpdateSockErrorHandler(errorHandler func(error)) {
@@ -146,6 +159,7 @@ func (s *Server) runHeartbeatCo() {
 func (s *Server) UpdateHealthCheckConfig(config *HealthCheckConfig) error {
 	s.configLock.Lock()
 	defer s.configLock.Unlock()
+	s.healthCheckEnabled = true
 	return s.healthCheck.UpdateConfig(config)
 }
 
@@ -167,6 +181,7 @@ func NewFromSocketFactoryWithPoolSize(socketFactory func() (net.Conn, error), po
 		logger:        log.New(os.Stdout, "snserver", log.LstdFlags),
 		cntlock:       sync.Mutex{},
 		configLock:    sync.RWMutex{},
+		decoder:       NewResultDecoder(),
 	}
 
 	healthCheck, err := NewHealthCheckService()
@@ -205,52 +220,134 @@ func NewWithTimeout(addr string, timeout time.Duration) (*Server, error) {
 }
 
 func (s *Server) DetectRequestInCtx(dc *detection.DetectionContext) (*detection.Result, error) {
+	if ret := s.filterRequest(dc); ret != nil {
+		s.emit(dc, ret)
+		return ret, nil
+	}
+	ret, err := s.detectRequestInCtx(dc)
+	if IsConnError(err) {
+		if fallback := s.detectorDown(dc); fallback != nil {
+			ret, err = fallback, nil
+		}
+	}
+	if err == nil {
+		s.emit(dc, ret)
+	}
+	return ret, err
+}
+
+// detectRequestInCtx fails with a connError when the detector can not be
+// reached, including ErrDetectorDown when the health check reports it down.
+func (s *Server) detectRequestInCtx(dc *detection.DetectionContext) (*detection.Result, error) {
+	if s.healthCheckDown() && s.getFallback() != nil {
+		return nil, &connError{err: ErrDetectorDown}
+	}
 	c, err := s.GetConn()
 	if err != nil {
-		return nil, err
+		return nil, &connError{err: err}
 	}
 	defer s.PutConn(c)
 	return c.DetectRequestInCtx(dc)
 }
 
+// DetectResponseInCtx skips the detector, passing the response, when the
+// request was passed locally, the same way Detect does.
 func (s *Server) DetectResponseInCtx(dc *detection.DetectionContext) (*detection.Result, error) {
+	if req := dc.LocalResult(); req != nil && req.Passed() {
+		ret := localResponse(req)
+		s.emit(dc, ret)
+		return ret, nil
+	}
 	c, err := s.GetConn()
 	if err != nil {
-		return nil, misc.ErrorWrap(err, "")
+		return nil, misc.ErrorWrap(&connError{err: err}, "")
 	}
 	defer s.PutConn(c)
-	return c.DetectResponseInCtx(dc)
+	ret, err := c.DetectResponseInCtx(dc)
+	if err == nil {
+		s.emit(dc, ret)
+	}
+	return ret, err
+}
+
+// localDetect completes Detect with a request result decided locally, a
+// locally passed request skips response detection as well.
+func (s *Server) localDetect(dc *detection.DetectionContext, ret *detection.Result) (*detection.Result, *detection.Result, error) {
+	var rspResult *detection.Result
+	if ret.Passed() && dc.Response != nil {
+		rspResult = localResponse(ret)
+	}
+	s.emit(dc, ret, rspResult)
+	return ret, rspResult, nil
+}
+
+// localResponse passes the response of a request passed locally.
+func localResponse(req *detection.Result) *detection.Result {
+	ret := detection.MakeLocalResult(req.Origin, true, 0)
+	ret.Objective = detection.RO_RESPONSE
+	return ret
 }
 
 func (s *Server) Detect(dc *detection.DetectionContext) (*detection.Result, *detection.Result, error) {
+	if dc.Request != nil {
+		if ret := s.filterRequest(dc); ret != nil {
+			return s.localDetect(dc, ret)
+		}
+	}
+	if s.healthCheckDown() && s.getFallback() != nil {
+		if ret := s.detectorDown(dc); ret != nil {
+			return s.localDetect(dc, ret)
+		}
+		return nil, nil, misc.ErrorWrap(ErrDetectorDown, "")
+	}
 	c, err := s.GetConn()
 	if err != nil {
+		if ret := s.detectorDown(dc); ret != nil {
+			return s.localDetect(dc, ret)
+		}
 		return nil, nil, misc.ErrorWrap(err, "")
 	}
 
 	reqResult, rspResult, err := c.Detect(dc)
-	if err == nil {
-		s.PutConn(c)
+	// a failed conn has reconnected or retries on its next use
+	s.PutConn(c)
+	if err != nil {
+		if IsConnError(err) {
+			if ret := s.detectorDown(dc); ret != nil {
+				return s.localDetect(dc, ret)
+			}
+		}
+		return reqResult, rspResult, err
 	}
-	return reqResult, rspResult, err
+	s.emit(dc, reqResult, rspResult)
+	return reqResult, rspResult, nil
 }
 
+// DetectHttpRequest replaces req.Body with a body replaying it in full,
+// the caller forwards it and must close it.
 func (s *Server) DetectHttpRequest(req *http.Request) (*detection.Result, error) {
-	c, err := s.GetConn()
+	dc, err := detection.MakeContextWithRequest(req)
 	if err != nil {
 		return nil, err
 	}
-	defer s.PutConn(c)
-	return c.DetectHttpRequest(req)
+	return s.DetectRequestInCtx(dc)
 }
 
 func (s *Server) DetectRequest(req detection.Request) (*detection.Result, error) {
 	c, err := s.GetConn()
 	if err != nil {
-		return nil, err
+		return nil, &connError{err: err}
 	}
 	defer s.PutConn(c)
-	return c.DetectRequest(req)
+	ret, err := c.DetectRequest(req)
+	if err == nil {
+		var dc *detection.DetectionContext
+		if p, ok := req.(detection.ContextProvider); ok {
+			dc = p.DetectionContext()
+		}
+		s.emit(dc, ret)
+	}
+	return ret, err
 }
 
 // blocks until all pending detection is completed
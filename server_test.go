@@ -0,0 +1,215 @@
+package t1k_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	t1kgo "github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/internal/detectortest"
+	"github.com/chaitin/t1k-go/t1k"
+)
+
+func TestDetectHttpRequestRemovesSpool(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	d := &detectortest.Detector{
+		Decide: func(sections map[t1k.Tag][]byte) *detectortest.Reply {
+			return detectortest.Pass()
+		},
+	}
+	server, err := d.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := strings.Repeat("a", 2<<20)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ret, err := server.DetectHttpRequest(r)
+		if err != nil || !ret.Passed() {
+			http.Error(w, "not passed", http.StatusInternalServerError)
+			return
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 1 {
+			http.Error(w, "body not spooled", http.StatusInternalServerError)
+			return
+		}
+		// the handler reads the replayed body but never closes it
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != payload {
+			http.Error(w, "replayed body mismatch", http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	rsp, err := http.Post(ts.URL, "text/plain", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("expect pass, got %d %s", rsp.StatusCode, msg)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := os.ReadDir(dir)
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spool file not removed, %d left", len(files))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type fallbackFunc func(dc *detection.DetectionContext) *detection.Result
+
+func (f fallbackFunc) FallbackRequest(dc *detection.DetectionContext) *detection.Result {
+	return f(dc)
+}
+
+func makeContext(t *testing.T) *detection.DetectionContext {
+	dc, err := detection.MakeContextWithRequest(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func TestFallbackOnlyOnConnectionErrors(t *testing.T) {
+	var malformed int32
+	d := &detectortest.Detector{
+		Decide: func(sections map[t1k.Tag][]byte) *detectortest.Reply {
+			if atomic.LoadInt32(&malformed) != 0 {
+				// a section not marked first
+				return &detectortest.Reply{Raw: []byte{byte(t1k.TAG_HEADER), 1, 0, 0, 0, '.'}}
+			}
+			return detectortest.Pass()
+		},
+	}
+	var down int32
+	var conn net.Conn
+	server, err := t1kgo.NewFromSocketFactoryWithPoolSize(func() (net.Conn, error) {
+		if atomic.LoadInt32(&down) != 0 {
+			return nil, errors.New("detector down")
+		}
+		c, err := d.Dial()
+		conn = c
+		return c, err
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.UpdateFallback(fallbackFunc(func(dc *detection.DetectionContext) *detection.Result {
+		return detection.MakeLocalResult(detection.ORIGIN_LOCAL_RULE, false, 403)
+	}))
+
+	atomic.StoreInt32(&malformed, 1)
+	if ret, err := server.DetectRequestInCtx(makeContext(t)); err == nil {
+		t.Fatalf("expect malformed answer reported, got %+v", ret)
+	}
+	// the conn goes back to the pool of one after each failure
+	for i := 0; i < 2; i++ {
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := server.Detect(makeContext(t))
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("expect malformed answer reported")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("conn not returned to the pool")
+		}
+	}
+
+	atomic.StoreInt32(&malformed, 0)
+	if ret, err := server.DetectRequestInCtx(makeContext(t)); err != nil || !ret.Passed() {
+		t.Fatalf("expect detector pass, got %+v %v", ret, err)
+	}
+
+	atomic.StoreInt32(&down, 1)
+	conn.Close()
+	ret, err := server.DetectRequestInCtx(makeContext(t))
+	if err != nil || ret.Origin != detection.ORIGIN_LOCAL_RULE {
+		t.Fatalf("expect fallback on connection failure, got %+v %v", ret, err)
+	}
+}
+
+type filterFunc func(dc *detection.DetectionContext) *detection.Result
+
+func (f filterFunc) FilterRequest(dc *detection.DetectionContext) *detection.Result {
+	return f(dc)
+}
+
+func TestDetectResponseAfterLocalPass(t *testing.T) {
+	var messages int32
+	d := &detectortest.Detector{
+		Decide: func(sections map[t1k.Tag][]byte) *detectortest.Reply {
+			atomic.AddInt32(&messages, 1)
+			return detectortest.Block("403", "rspevent")
+		},
+	}
+	server, err := d.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.UpdateRequestFilters(filterFunc(func(dc *detection.DetectionContext) *detection.Result {
+		if dc.RemoteAddr == "10.0.0.1" {
+			return detection.MakeLocalResult(detection.ORIGIN_LOCAL_RULE, true, 0)
+		}
+		return nil
+	}))
+
+	detect := func(remoteAddr string) *detection.Result {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr + ":1234"
+		dc, err := detection.MakeContextWithRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret, err := server.DetectRequestInCtx(dc); err != nil {
+			t.Fatal(err)
+		} else if remoteAddr == "10.0.0.1" && !ret.Passed() {
+			t.Fatalf("expect local pass, got %+v", ret)
+		}
+		rsp := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+		}
+		detection.MakeHttpResponseInCtx(rsp, dc)
+		ret, err := server.DetectResponseInCtx(dc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+
+	ret := detect("10.0.0.1")
+	if !ret.Passed() || !ret.IsLocal() || ret.Objective != detection.RO_RESPONSE {
+		t.Fatalf("expect local response pass, got %+v", ret)
+	}
+	if n := atomic.LoadInt32(&messages); n != 0 {
+		t.Fatalf("expect no message to the detector, got %d", n)
+	}
+
+	// the detector decides on the responses of other clients
+	if ret := detect("10.0.0.2"); !ret.Blocked() || ret.IsLocal() {
+		t.Fatalf("expect detector block, got %+v", ret)
+	}
+}
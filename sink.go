@@ -0,0 +1,44 @@
+package t1k
+
+import (
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/event"
+)
+
+// UpdateEventSinks sets the sinks every detection result is emitted to,
+// local results of request filters included. Passed results are only
+// emitted to sinks which are not event.BlockedOnly.
+func (s *Server) UpdateEventSinks(sinks ...event.Sink) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.sinks = sinks
+}
+
+func (s *Server) emit(dc *detection.DetectionContext, results ...*detection.Result) {
+	s.configLock.RLock()
+	sinks := s.sinks
+	s.configLock.RUnlock()
+	if len(sinks) == 0 {
+		return
+	}
+	for _, ret := range results {
+		if ret == nil {
+			continue
+		}
+		var e *event.Event
+		for _, sink := range sinks {
+			if ret.Passed() && onlyBlocked(sink) {
+				continue
+			}
+			if e == nil {
+				e = event.New(dc, ret)
+			}
+			sink.Emit(e)
+		}
+	}
+}
+
+func onlyBlocked(sink event.Sink) bool {
+	f, ok := sink.(event.BlockedOnly)
+	return ok && f.OnlyBlocked()
+}
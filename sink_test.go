@@ -0,0 +1,104 @@
+package t1k_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/event"
+	"github.com/chaitin/t1k-go/internal/detectortest"
+	"github.com/chaitin/t1k-go/t1k"
+)
+
+type memorySink struct {
+	lock   sync.Mutex
+	events []*event.Event
+}
+
+func (s *memorySink) Emit(e *event.Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, e)
+}
+
+func TestServerEmitsEvents(t *testing.T) {
+	d := &detectortest.Detector{
+		Decide: func(sections map[t1k.Tag][]byte) *detectortest.Reply {
+			if bytes.Contains(sections[t1k.TAG_HEADER], []byte("attack")) {
+				return detectortest.Block("403", "abc123")
+			}
+			return detectortest.Pass()
+		},
+	}
+	server, err := d.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memorySink{}
+	server.UpdateEventSinks(sink)
+
+	for _, uri := range []string{"/index", "/?q=attack"} {
+		req := httptest.NewRequest("GET", "http://a.com"+uri, nil)
+		if _, err := server.DetectHttpRequest(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sink.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(sink.events))
+	}
+	e := sink.events[1]
+	if e.URI != "" {
+		t.Fatal("request line decoded on the detection path")
+	}
+	e.Decode()
+	if e.Verdict != detection.VERDICT_BLOCK.String() || e.EventID != "abc123" || e.StatusCode != 403 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if e.Method != "GET" || e.URI != "/?q=attack" || e.Host != "a.com" || e.RemoteAddr != "192.0.2.1" {
+		t.Fatalf("request not recorded %+v", e)
+	}
+	if !e.Blocked() || sink.events[0].Blocked() {
+		t.Fatal("unexpected blocked state")
+	}
+}
+
+type blockedSink struct {
+	memorySink
+}
+
+func (s *blockedSink) OnlyBlocked() bool {
+	return true
+}
+
+func TestServerSkipsPassesForBlockedOnlySinks(t *testing.T) {
+	d := &detectortest.Detector{
+		Decide: func(sections map[t1k.Tag][]byte) *detectortest.Reply {
+			if bytes.Contains(sections[t1k.TAG_HEADER], []byte("attack")) {
+				return detectortest.Block("403", "abc123")
+			}
+			return detectortest.Pass()
+		},
+	}
+	server, err := d.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := &memorySink{}
+	blocked := &blockedSink{}
+	server.UpdateEventSinks(blocked, all)
+
+	for _, uri := range []string{"/index", "/?q=attack"} {
+		req := httptest.NewRequest("GET", "http://a.com"+uri, nil)
+		if _, err := server.DetectHttpRequest(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(all.events) != 2 || len(blocked.events) != 1 || !blocked.events[0].Blocked() {
+		t.Fatalf("expected 2 events and 1 blocked one, got %d and %d", len(all.events), len(blocked.events))
+	}
+	if blocked.events[0] != all.events[1] {
+		t.Fatal("sinks should share the event of a result")
+	}
+}
@@ -2,7 +2,10 @@ package t1k
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 
 	"github.com/chaitin/t1k-go/misc"
 )
@@ -56,6 +59,10 @@ func (msg *ReaderSection) WriteBody(w io.Writer) error {
 	return misc.ErrorWrap(err, "")
 }
 
+func (msg *ReaderSection) Read(p []byte) (int, error) {
+	return msg.reader.Read(p)
+}
+
 func WriteSection(s Section, w io.Writer) error {
 	h := s.Header()
 	_, err := w.Write(h.Serialize())
@@ -68,6 +75,17 @@ func WriteSection(s Section, w io.Writer) error {
 // returns a *ReaderSection, must call its WriteBody
 // before next call to r
 func ReadSection(r io.Reader) (Section, error) {
+	sec, err := ReadReaderSection(r)
+	if err != nil {
+		return nil, err
+	}
+	return sec, nil
+}
+
+// ReadReaderSection is ReadSection returning the *ReaderSection, its body
+// can then be streamed by Read, which must reach the end of the body
+// before next call to r.
+func ReadReaderSection(r io.Reader) (*ReaderSection, error) {
 	bHeader := make([]byte, T1K_HEADER_SIZE)
 	_, err := io.ReadFull(r, bHeader)
 	if err != nil {
@@ -93,3 +111,133 @@ func ReadFullSection(r io.Reader) (Section, error) {
 	}
 	return MakeSimpleSection(h.Tag, buf.Bytes()), nil
 }
+
+// ErrSectionTooLarge is returned when a body of 4 GiB or more is asked
+// for with a uint32 size, it must then be sent by WriteSplitSection.
+var ErrSectionTooLarge = errors.New("section body of 4 GiB or more")
+
+// a section body of exactly maxSectionSize bytes is always followed by a
+// continuation section carrying the same tag, the last part of a split
+// body is shorter, possibly empty
+var maxSectionSize int64 = math.MaxUint32
+
+// WriteSplitSection writes size bytes from reader as one or more
+// consecutive sections carrying tag, so that bodies of 4 GiB or more
+// can be sent. MASK_FIRST is kept on the first part, MASK_LAST on the last.
+func WriteSplitSection(tag Tag, size int64, reader io.Reader, w io.Writer) error {
+	if size < 0 {
+		return fmt.Errorf("section <%x> of negative size %d", tag, size)
+	}
+	first := tag & MASK_FIRST
+	last := tag & MASK_LAST
+	tag = tag.Strip() | first
+	for {
+		partSize := size
+		if partSize >= maxSectionSize {
+			partSize = maxSectionSize
+		} else {
+			tag |= last
+		}
+		sec := MakeReaderSection(tag, uint32(partSize), reader)
+		err := WriteSection(sec, w)
+		if err != nil {
+			return err
+		}
+		if partSize < maxSectionSize {
+			return nil
+		}
+		size -= partSize
+		tag = tag.Strip()
+	}
+}
+
+// SplitSection is a section reassembled from its continuations, as
+// written by WriteSplitSection.
+type SplitSection struct {
+	r      io.Reader
+	header Header
+	first  Tag
+	remain int64 // unread bytes of the current part
+	size   int64
+	done   bool
+}
+
+// ReadSplitSection reads the header of the next section. Its body and
+// continuations are read by Read or WriteBody, which must reach the end
+// of the body before next call to r.
+func ReadSplitSection(r io.Reader) (*SplitSection, error) {
+	bHeader := make([]byte, T1K_HEADER_SIZE)
+	_, err := io.ReadFull(r, bHeader)
+	if err != nil {
+		return nil, err
+	}
+	h := DeserializeHeader(bHeader)
+	return &SplitSection{
+		r:      r,
+		header: h,
+		first:  h.Tag & MASK_FIRST,
+		remain: int64(h.Size),
+	}, nil
+}
+
+// Tag returns the tag of the section. MASK_LAST is only known once the
+// last part was read.
+func (msg *SplitSection) Tag() Tag {
+	return msg.header.Tag
+}
+
+// Size returns the joined body size read so far.
+func (msg *SplitSection) Size() int64 {
+	return msg.size
+}
+
+// endPart reads the header of the next part once the current one is read,
+// or marks the section done.
+func (msg *SplitSection) endPart() error {
+	if int64(msg.header.Size) < maxSectionSize || msg.header.Tag.IsLast() {
+		msg.header.Tag |= msg.first
+		msg.done = true
+		return nil
+	}
+	bHeader := make([]byte, T1K_HEADER_SIZE)
+	_, err := io.ReadFull(msg.r, bHeader)
+	if err != nil {
+		return misc.ErrorWrap(err, "read continuation")
+	}
+	next := DeserializeHeader(bHeader)
+	if next.Tag.Strip() != msg.header.Tag.Strip() || next.Tag.IsFirst() {
+		return fmt.Errorf("continuation of section <%x> has tag <%x>", msg.header.Tag, next.Tag)
+	}
+	msg.header = next
+	msg.remain = int64(next.Size)
+	return nil
+}
+
+func (msg *SplitSection) Read(p []byte) (int, error) {
+	for msg.remain == 0 {
+		if msg.done {
+			return 0, io.EOF
+		}
+		if err := msg.endPart(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > msg.remain {
+		p = p[:msg.remain]
+	}
+	n, err := msg.r.Read(p)
+	msg.remain -= int64(n)
+	msg.size += int64(n)
+	if err == io.EOF {
+		if msg.remain > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (msg *SplitSection) WriteBody(w io.Writer) error {
+	_, err := io.Copy(w, msg)
+	return misc.ErrorWrap(err, "")
+}
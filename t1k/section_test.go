@@ -2,7 +2,10 @@ package t1k
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"testing"
 
 	"github.com/chaitin/t1k-go/misc"
@@ -62,3 +65,124 @@ func TestSectionSplit(t *testing.T) {
 	}
 	fmt.Printf("%v\n%v %v\n%v\n", sec1, sec2, bodyBuf, sec3)
 }
+
+func TestSplitSectionRoundTrip(t *testing.T) {
+	saved := maxSectionSize
+	maxSectionSize = 4
+	defer func() { maxSectionSize = saved }()
+
+	for _, body := range []string{"", "abc", "abcd", "abcdefghij", "abcdefgh"} {
+		var buf bytes.Buffer
+		err := WriteSplitSection(TAG_BODY|MASK_FIRST|MASK_LAST, int64(len(body)), bytes.NewBufferString(body), &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := len(body)/4 + 1
+		if buf.Len() != parts*int(T1K_HEADER_SIZE)+len(body) {
+			t.Fatalf("%q: expect %d parts, got %d bytes", body, parts, buf.Len())
+		}
+		if tag := Tag(buf.Bytes()[0]); parts > 1 && tag.IsLast() {
+			t.Fatalf("%q: first part should not be last", body)
+		}
+
+		sec, err := ReadSplitSection(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bodyBuf bytes.Buffer
+		err = sec.WriteBody(&bodyBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyBuf.String() != body || sec.Size() != int64(len(body)) {
+			t.Fatalf("expect %q, got %q", body, bodyBuf.String())
+		}
+		if sec.Tag() != TAG_BODY|MASK_FIRST|MASK_LAST {
+			t.Fatalf("%q: unexpected joined tag <%x>", body, sec.Tag())
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%q: %d bytes left unread", body, buf.Len())
+		}
+	}
+}
+
+func TestSplitSectionFollowedBySection(t *testing.T) {
+	saved := maxSectionSize
+	maxSectionSize = 4
+	defer func() { maxSectionSize = saved }()
+
+	var buf bytes.Buffer
+	err := WriteSplitSection(TAG_RSP_BODY, 6, bytes.NewBufferString("abcdefgh"), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteSection(MakeSimpleSection(TAG_RSP_EXTRA|MASK_LAST, []byte("x")), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sec, err := ReadSplitSection(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// streamed in small reads across the parts
+	body, err := io.ReadAll(io.LimitReader(sec, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "abcdef" || sec.Tag() != TAG_RSP_BODY {
+		t.Fatalf("unexpected section <%x> %q", sec.Tag(), body)
+	}
+	next, err := ReadFullSection(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Header().Tag != TAG_RSP_EXTRA|MASK_LAST {
+		t.Fatalf("unexpected next section <%x>", next.Header().Tag)
+	}
+}
+
+func TestSplitSectionBadContinuation(t *testing.T) {
+	saved := maxSectionSize
+	maxSectionSize = 4
+	defer func() { maxSectionSize = saved }()
+
+	data := []byte{
+		0x02, 0x04, 0x00, 0x00, 0x00, // full part of TAG_BODY
+		0xaa, 0xaa, 0xaa, 0xaa,
+		0x03, 0x00, 0x00, 0x00, 0x00, // not a continuation
+	}
+	sec, err := ReadSplitSection(bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodyBuf bytes.Buffer
+	if err = sec.WriteBody(&bodyBuf); err == nil {
+		t.Fatal("expect error for broken continuation")
+	}
+}
+
+func TestSplitSectionLargeSize(t *testing.T) {
+	// the real limit, the body is never there
+	w := &limitedWriter{max: 2 * int(T1K_HEADER_SIZE)}
+	err := WriteSplitSection(TAG_BODY, math.MaxUint32+1, bytes.NewReader(nil), w)
+	if err == nil || w.buf.Len() != int(T1K_HEADER_SIZE) {
+		t.Fatalf("expect the empty body to fail after the first header, got %v", err)
+	}
+	if h := DeserializeHeader(w.buf.Bytes()); h.Size != math.MaxUint32 || h.Tag != TAG_BODY {
+		t.Fatalf("unexpected first part header %+v", h)
+	}
+}
+
+// limitedWriter fails once more than max bytes were written.
+type limitedWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.max {
+		return 0, errors.New("too much written")
+	}
+	return w.buf.Write(p)
+}
@@ -0,0 +1,210 @@
+package t1khttp
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+const (
+	FORMAT_TEXT = "text/plain"
+	FORMAT_HTML = "text/html"
+	FORMAT_JSON = "application/json"
+)
+
+var (
+	defaultTextTemplate = texttemplate.Must(texttemplate.New("text").Parse(
+		"blocked event id {{.EventID}}\n",
+	))
+	defaultHTMLTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(
+		"<!DOCTYPE html>\n<html><head><title>{{.StatusCode}} {{.StatusText}}</title></head>\n" +
+			"<body><h1>{{.StatusText}}</h1><p>{{.Message}}</p>\n" +
+			"<p>Event ID: {{.EventID}}<br>Request ID: {{.UUID}}<br>Time: {{.Time.Format \"2006-01-02 15:04:05 MST\"}}</p>\n" +
+			"</body></html>\n",
+	))
+)
+
+// BlockPage holds the values available to block templates.
+type BlockPage struct {
+	StatusCode int
+	StatusText string
+	EventID    string
+	UUID       string
+	Time       time.Time
+	Message    string
+	// Location is the target of a redirecting block
+	Location string
+}
+
+// redirectLocation returns the Location the detector sends along with a
+// redirect status code, "" when there is none.
+func redirectLocation(statusCode int, result *detection.Result) string {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return ""
+	}
+	header, err := result.ParseExtraHeader()
+	if err != nil {
+		return ""
+	}
+	return header.Get("Location")
+}
+
+// MakeBlockPage keeps the status code of result when it is an error, or a
+// redirect along with a Location header, others are answered with 403.
+func MakeBlockPage(dc *detection.DetectionContext, result *detection.Result) *BlockPage {
+	statusCode := result.StatusCode()
+	location := redirectLocation(statusCode, result)
+	if location == "" && (statusCode < 400 || statusCode > 599) {
+		// the code comes from the detector, net/http panics on some
+		// and a block must not answer with a success
+		statusCode = http.StatusForbidden
+	}
+	ret := &BlockPage{
+		StatusCode: statusCode,
+		StatusText: http.StatusText(statusCode),
+		Location:   location,
+		EventID:    result.EventID(),
+		Time:       time.Now(),
+		Message:    "blocked by Chaitin SafeLine Web Application Firewall",
+	}
+	if dc != nil {
+		ret.UUID = dc.UUID
+		if dc.ReqBeginTime != 0 {
+			// ReqBeginTime is in microseconds
+			ret.Time = time.Unix(0, dc.ReqBeginTime*int64(time.Microsecond))
+		}
+	}
+	return ret
+}
+
+// BlockRenderer writes block responses in the format preferred by the
+// Accept header of the request, among HTML, JSON and plain text. Nil
+// templates are replaced by built-in ones, except that the HTML page
+// provided by the detector in Result.ExtraBody is preferred over the
+// built-in HTML template when present.
+type BlockRenderer struct {
+	HTMLTemplate *htmltemplate.Template
+	JSONTemplate *texttemplate.Template
+	TextTemplate *texttemplate.Template
+	// Message is shown on built-in pages, defaults to the SafeLine message.
+	Message string
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(accept string) []acceptRange {
+	var ret []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		ret = append(ret, acceptRange{mediaType: mediaType, q: q})
+	}
+	// keep the order of the header between equal weights
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].q > ret[j].q
+	})
+	return ret
+}
+
+// NegotiateFormat returns FORMAT_HTML, FORMAT_JSON or FORMAT_TEXT for an
+// Accept header, plain text being used for wildcards and unknown types.
+func NegotiateFormat(accept string) string {
+	for _, ar := range parseAccept(accept) {
+		if ar.q <= 0 {
+			continue
+		}
+		switch ar.mediaType {
+		case FORMAT_HTML, "application/xhtml+xml":
+			return FORMAT_HTML
+		case FORMAT_JSON:
+			return FORMAT_JSON
+		case FORMAT_TEXT, "text/*", "*/*":
+			return FORMAT_TEXT
+		}
+	}
+	return FORMAT_TEXT
+}
+
+func (br *BlockRenderer) render(format string, page *BlockPage, result *detection.Result) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case FORMAT_HTML:
+		if br.HTMLTemplate != nil {
+			err := br.HTMLTemplate.Execute(&buf, page)
+			return buf.Bytes(), err
+		}
+		if len(result.ExtraBody) > 0 {
+			return result.ExtraBody, nil
+		}
+		err := defaultHTMLTemplate.Execute(&buf, page)
+		return buf.Bytes(), err
+	case FORMAT_JSON:
+		if br.JSONTemplate != nil {
+			err := br.JSONTemplate.Execute(&buf, page)
+			return buf.Bytes(), err
+		}
+		return json.Marshal(map[string]interface{}{
+			"status":   page.StatusCode,
+			"success":  false,
+			"message":  page.Message,
+			"event_id": page.EventID,
+			"uuid":     page.UUID,
+			"time":     page.Time.Unix(),
+		})
+	}
+	tmpl := br.TextTemplate
+	if tmpl == nil {
+		tmpl = defaultTextTemplate
+	}
+	err := tmpl.Execute(&buf, page)
+	return buf.Bytes(), err
+}
+
+// Render can be used as Options.BlockHandler.
+func (br *BlockRenderer) Render(w http.ResponseWriter, r *http.Request, dc *detection.DetectionContext, result *detection.Result) {
+	page := MakeBlockPage(dc, result)
+	if br.Message != "" {
+		page.Message = br.Message
+	}
+	format := NegotiateFormat(r.Header.Get("Accept"))
+	body, err := br.render(format, page, result)
+	if err != nil {
+		// a broken user template must not turn a block into a pass
+		format = FORMAT_TEXT
+		body, _ = (&BlockRenderer{}).render(format, page, result)
+	}
+	w.Header().Set("Content-Type", format+"; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	if page.Location != "" {
+		w.Header().Set("Location", page.Location)
+	}
+	w.WriteHeader(page.StatusCode)
+	_, _ = w.Write(body)
+}
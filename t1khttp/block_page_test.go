@@ -0,0 +1,106 @@
+package t1khttp
+
+import (
+	"encoding/json"
+	htmltemplate "html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := map[string]string{
+		"":    FORMAT_TEXT,
+		"*/*": FORMAT_TEXT,
+		"text/html,application/xhtml+xml,*/*;q=0.8": FORMAT_HTML,
+		"application/json":                          FORMAT_JSON,
+		"text/html;q=0.5, application/json":         FORMAT_JSON,
+		"application/json;q=0, text/plain":          FORMAT_TEXT,
+		"image/png":                                 FORMAT_TEXT,
+	}
+	for accept, expect := range cases {
+		if got := NegotiateFormat(accept); got != expect {
+			t.Errorf("NegotiateFormat(%q) = %s, expect %s", accept, got, expect)
+		}
+	}
+}
+
+func renderBlock(br *BlockRenderer, accept string, result *detection.Result) *httptest.ResponseRecorder {
+	dc := detection.New()
+	dc.UUID = "req-uuid"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", accept)
+	rec := httptest.NewRecorder()
+	br.Render(rec, req, dc, result)
+	return rec
+}
+
+func TestBlockRenderer(t *testing.T) {
+	result := &detection.Result{
+		Head:      '?',
+		Body:      []byte("405"),
+		ExtraBody: []byte("<html><!-- event_id: abc123 --></html>"),
+	}
+
+	rec := renderBlock(&BlockRenderer{}, "application/json", result)
+	var msg map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != 405 || msg["event_id"] != "abc123" || msg["uuid"] != "req-uuid" {
+		t.Fatalf("unexpected json block page %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = renderBlock(&BlockRenderer{}, "text/html", result)
+	if rec.Body.String() != string(result.ExtraBody) {
+		t.Fatalf("expect detector page, got %q", rec.Body.String())
+	}
+
+	br := &BlockRenderer{
+		HTMLTemplate: htmltemplate.Must(htmltemplate.New("").Parse("<p>{{.EventID}} {{.UUID}} {{.StatusCode}}</p>")),
+	}
+	rec = renderBlock(br, "text/html", result)
+	if rec.Body.String() != "<p>abc123 req-uuid 405</p>" {
+		t.Fatalf("unexpected html block page %q", rec.Body.String())
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), FORMAT_HTML) {
+		t.Fatalf("unexpected content type %s", rec.Header().Get("Content-Type"))
+	}
+
+	rec = renderBlock(&BlockRenderer{}, "", result)
+	if rec.Body.String() != "blocked event id abc123\n" {
+		t.Fatalf("unexpected text block page %q", rec.Body.String())
+	}
+}
+
+func TestBlockRendererStatusCode(t *testing.T) {
+	for _, code := range []string{"0", "99", "200", "302", "600", "1000"} {
+		result := &detection.Result{
+			Head: '?',
+			Body: []byte(code),
+		}
+		rec := renderBlock(&BlockRenderer{}, "", result)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("status %s: expect 403, got %d", code, rec.Code)
+		}
+	}
+
+	// redirects are kept along with the Location sent by the detector
+	result := &detection.Result{
+		Head:        '?',
+		Body:        []byte("302"),
+		ExtraHeader: []byte("Location: /blocked\r\n"),
+	}
+	rec := renderBlock(&BlockRenderer{}, "", result)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/blocked" {
+		t.Fatalf("expect redirect to /blocked, got %d %v", rec.Code, rec.Header())
+	}
+	// a code which is not a redirect is still coerced
+	result.Body = []byte("304")
+	if rec := renderBlock(&BlockRenderer{}, "", result); rec.Code != http.StatusForbidden || rec.Header().Get("Location") != "" {
+		t.Fatalf("expect 403 without Location, got %d %v", rec.Code, rec.Header())
+	}
+}
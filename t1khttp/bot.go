@@ -0,0 +1,89 @@
+package t1khttp
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/detection"
+)
+
+const (
+	// at most this many bot queries are remembered by a Middleware, the
+	// detector normally uses a single one
+	maxBotQueries = 16
+)
+
+// ErrNoBotAnswer is returned by VerifyBotAnswer for requests without an
+// answer.
+var ErrNoBotAnswer = errors.New("t1k: request carries no bot challenge answer")
+
+// ServeBotChallenge writes the bot-protection challenge of result, it is
+// the default Options.ChallengeHandler.
+func ServeBotChallenge(w http.ResponseWriter, r *http.Request, dc *detection.DetectionContext, result *detection.Result) {
+	challenge := result.BotChallenge()
+	if challenge == nil {
+		defaultBlockRenderer.Render(w, r, dc, result)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(challenge.Body))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(challenge.StatusCode)
+	_, _ = w.Write(challenge.Body)
+}
+
+// VerifyBotAnswer sends a request carrying the answer to a challenge whose
+// Query is query to the detector, for answer endpoints served outside of
+// Middleware. It fails with ErrNoBotAnswer when r carries no answer. On
+// success, the returned result holds the cookies to apply to the response.
+func VerifyBotAnswer(server *t1k.Server, r *http.Request, query []byte) (bool, *detection.Result, error) {
+	if _, ok := detection.BotAnswer(r, query); !ok {
+		return false, nil, ErrNoBotAnswer
+	}
+	result, err := server.DetectHttpRequest(r)
+	if err != nil {
+		return false, nil, err
+	}
+	return botAnswerAccepted(result), result, nil
+}
+
+func botAnswerAccepted(result *detection.Result) bool {
+	return result.Passed() && !result.IsBotChallenge()
+}
+
+// botQueries keeps the queries of the challenges a Middleware served, to
+// recognize the requests answering them.
+type botQueries struct {
+	lock    sync.RWMutex
+	queries []string
+}
+
+func (q *botQueries) add(query []byte) {
+	if len(query) == 0 {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, known := range q.queries {
+		if known == string(query) {
+			return
+		}
+	}
+	if len(q.queries) >= maxBotQueries {
+		q.queries = q.queries[1:]
+	}
+	q.queries = append(q.queries, string(query))
+}
+
+// answered tells whether r carries an answer to one of the queries.
+func (q *botQueries) answered(r *http.Request) bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	for _, query := range q.queries {
+		if _, ok := detection.BotAnswer(r, []byte(query)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+package t1khttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/detection"
+)
+
+type Options struct {
+	// FailOpen passes requests to the handler when detection fails,
+	// otherwise they are answered with 503 Service Unavailable.
+	FailOpen bool
+	// DetectResponse buffers the response of the handler and sends it to
+	// the detector in the same DetectionContext as the request.
+	DetectResponse bool
+	// PrepareContext is called on every new DetectionContext, e.g. to set
+	// BodyLimit, before the request is detected.
+	PrepareContext func(dc *detection.DetectionContext)
+	// BlockHandler writes the response for a blocked request or response,
+	// defaults to rendering a BlockRenderer without templates.
+	BlockHandler func(w http.ResponseWriter, r *http.Request, dc *detection.DetectionContext, result *detection.Result)
+	// ChallengeHandler serves bot-protection challenges, defaults to
+	// ServeBotChallenge.
+	ChallengeHandler func(w http.ResponseWriter, r *http.Request, dc *detection.DetectionContext, result *detection.Result)
+	// ErrorHook is called with every detection error, whatever FailOpen is.
+	ErrorHook func(r *http.Request, err error)
+}
+
+type contextKey struct{}
+
+type detectionState struct {
+	dc        *detection.DetectionContext
+	result    *detection.Result
+	rspResult *detection.Result
+	blocked   *detection.Result
+	err       error
+}
+
+// FromContext returns the DetectionContext and the request result stored
+// by Middleware or InstallReverseProxy, or nils when the request was not
+// detected.
+func FromContext(ctx context.Context) (*detection.DetectionContext, *detection.Result) {
+	state, ok := ctx.Value(contextKey{}).(*detectionState)
+	if !ok {
+		return nil, nil
+	}
+	return state.dc, state.result
+}
+
+func withState(r *http.Request, state *detectionState) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, state))
+}
+
+var defaultBlockRenderer = &BlockRenderer{}
+
+// apply sets the headers and cookies of result on w.
+func (o *Options) apply(w http.ResponseWriter, r *http.Request, result *detection.Result) {
+	err := result.ApplyTo(w)
+	if err != nil && o.ErrorHook != nil {
+		o.ErrorHook(r, err)
+	}
+}
+
+// applyResponse sets the headers and cookies of result on rsp.
+func (o *Options) applyResponse(rsp *http.Response, result *detection.Result) {
+	err := result.ApplyToResponse(rsp)
+	if err != nil && o.ErrorHook != nil {
+		o.ErrorHook(rsp.Request, err)
+	}
+}
+
+func (o *Options) block(w http.ResponseWriter, r *http.Request, dc *detection.DetectionContext, result *detection.Result) {
+	if o.ErrorHook != nil {
+		if _, err := result.ParseStatusCode(); err != nil {
+			o.ErrorHook(r, err)
+		}
+		if _, err := result.ParseEventID(); err != nil {
+			o.ErrorHook(r, err)
+		}
+	}
+	o.apply(w, r, result)
+	if result.IsBotChallenge() {
+		if o.ChallengeHandler != nil {
+			o.ChallengeHandler(w, r, dc, result)
+			return
+		}
+		ServeBotChallenge(w, r, dc, result)
+		return
+	}
+	if o.BlockHandler != nil {
+		o.BlockHandler(w, r, dc, result)
+		return
+	}
+	defaultBlockRenderer.Render(w, r, dc, result)
+}
+
+// fail reports err and tells whether the request may go on.
+func (o *Options) fail(w http.ResponseWriter, r *http.Request, err error) bool {
+	if o.ErrorHook != nil {
+		o.ErrorHook(r, err)
+	}
+	if o.FailOpen {
+		return true
+	}
+	writeFailure(w)
+	return false
+}
+
+// failRequest is fail for requests, those answering a bot challenge never
+// go on without the detector verifying the answer.
+func (o *Options) failRequest(w http.ResponseWriter, r *http.Request, err error, answer bool) bool {
+	if !answer {
+		return o.fail(w, r, err)
+	}
+	if o.ErrorHook != nil {
+		o.ErrorHook(r, err)
+	}
+	writeFailure(w)
+	return false
+}
+
+func writeFailure(w http.ResponseWriter) {
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// Middleware detects every request with server before passing it to the
+// wrapped handler. Blocked requests are answered by opts.BlockHandler,
+// challenged ones by opts.ChallengeHandler. Requests answering a challenge
+// served before are forwarded, answer included, only once detection
+// accepted the answer, whatever opts.FailOpen is.
+// With opts.DetectResponse, the handler response is buffered and
+// detected too, so handlers can not stream or hijack the connection.
+func Middleware(server *t1k.Server, opts *Options) func(http.Handler) http.Handler {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return func(next http.Handler) http.Handler {
+		queries := &botQueries{}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			answer := queries.answered(r)
+			dc, err := detection.MakeContextWithRequest(r)
+			if err != nil {
+				if opts.failRequest(w, r, err, answer) {
+					next.ServeHTTP(w, r)
+				}
+				return
+			}
+			if opts.PrepareContext != nil {
+				opts.PrepareContext(dc)
+			}
+			result, err := server.DetectRequestInCtx(dc)
+			// r.Body now replays the request and may hold a spool file,
+			// net/http only closes the body it set itself
+			if r.Body != nil {
+				defer r.Body.Close()
+			}
+			if err != nil {
+				if opts.failRequest(w, r, err, answer) {
+					next.ServeHTTP(w, withState(r, &detectionState{dc: dc}))
+				}
+				return
+			}
+			if result.Blocked() || result.IsBotChallenge() {
+				queries.add(result.BotQuery)
+				opts.block(w, r, dc, result)
+				return
+			}
+			opts.apply(w, r, result)
+			r = withState(r, &detectionState{dc: dc, result: result})
+			if !opts.DetectResponse {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := newResponseRecorder()
+			next.ServeHTTP(rec, r)
+			rsp := rec.response(r)
+			detection.MakeHttpResponseInCtx(rsp, dc)
+			rspResult, err := server.DetectResponseInCtx(dc)
+			if err != nil && !opts.fail(w, r, err) {
+				rsp.Body.Close()
+				return
+			}
+			if err == nil && (rspResult.Blocked() || rspResult.IsBotChallenge()) {
+				rsp.Body.Close()
+				opts.block(w, r, dc, rspResult)
+				return
+			}
+			if err == nil {
+				opts.applyResponse(rsp, rspResult)
+			}
+			writeResponse(w, rsp)
+		})
+	}
+}
+
+type responseRecorder struct {
+	header      http.Header
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{
+		header:     make(http.Header),
+		statusCode: http.StatusOK,
+	}
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.statusCode = statusCode
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+func (rec *responseRecorder) response(r *http.Request) *http.Response {
+	header := rec.header.Clone()
+	if header.Get("Content-Type") == "" && rec.body.Len() > 0 {
+		header.Set("Content-Type", http.DetectContentType(rec.body.Bytes()))
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(rec.statusCode) + " " + http.StatusText(rec.statusCode),
+		StatusCode:    rec.statusCode,
+		Proto:         r.Proto,
+		ProtoMajor:    r.ProtoMajor,
+		ProtoMinor:    r.ProtoMinor,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(rec.body.Bytes())),
+		ContentLength: int64(rec.body.Len()),
+		Request:       r,
+	}
+}
+
+// writeResponse writes rsp to w, keeping the cookies already set on w from
+// the request result the way a handler writing to w directly would.
+func writeResponse(w http.ResponseWriter, rsp *http.Response) {
+	defer rsp.Body.Close()
+	for k, vv := range rsp.Header {
+		if k == "Set-Cookie" {
+			w.Header()[k] = append(w.Header()[k], vv...)
+			continue
+		}
+		w.Header()[k] = vv
+	}
+	w.WriteHeader(rsp.StatusCode)
+	_, _ = io.Copy(w, rsp.Body)
+}
@@ -0,0 +1,267 @@
+package t1khttp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/chaitin/t1k-go/internal/detectortest"
+	t1kproto "github.com/chaitin/t1k-go/t1k"
+)
+
+func newTestServer(t *testing.T) *t1k.Server {
+	d := &detectortest.Detector{
+		Decide: func(sections map[t1kproto.Tag][]byte) *detectortest.Reply {
+			if bytes.Contains(sections[t1kproto.TAG_HEADER], []byte("sl-answer=42")) {
+				return &detectortest.Reply{
+					Head: '.',
+					Sections: []t1kproto.Section{
+						t1kproto.MakeSimpleSection(t1kproto.TAG_COOKIE, []byte("sl-verified=1; Path=/\n")),
+					},
+				}
+			}
+			if bytes.Contains(sections[t1kproto.TAG_HEADER], []byte("bot-challenge")) ||
+				bytes.Contains(sections[t1kproto.TAG_HEADER], []byte("sl-answer=")) {
+				return &detectortest.Reply{
+					Head: '?',
+					Sections: []t1kproto.Section{
+						t1kproto.MakeSimpleSection(t1kproto.TAG_BOT_QUERY, []byte("sl-answer")),
+						t1kproto.MakeSimpleSection(t1kproto.TAG_BOT_BODY, []byte("<html>prove you are human</html>")),
+					},
+				}
+			}
+			if bytes.Contains(sections[t1kproto.TAG_RSP_BODY], []byte("secret")) {
+				return detectortest.Block("451", "rspevent")
+			}
+			if bytes.Contains(sections[t1kproto.TAG_HEADER], []byte("cookie")) {
+				return &detectortest.Reply{
+					Head: '.',
+					Sections: []t1kproto.Section{
+						t1kproto.MakeSimpleSection(t1kproto.TAG_EXTRA_HEADER, []byte("X-Waf: checked\r\n")),
+						t1kproto.MakeSimpleSection(t1kproto.TAG_COOKIE, []byte("sl-session=abc; Path=/\n")),
+					},
+				}
+			}
+			if bytes.Contains(sections[t1kproto.TAG_HEADER], []byte("attack")) {
+				return detectortest.Block("403", "reqevent")
+			}
+			return detectortest.Pass()
+		},
+	}
+	server, err := d.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	dc, result := FromContext(r.Context())
+	if dc == nil || result == nil || !result.Passed() {
+		http.Error(w, "detection state missing", http.StatusInternalServerError)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("X-Upstream", "yes")
+	_, _ = w.Write(body)
+}
+
+func serve(h http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+func TestMiddlewareRequest(t *testing.T) {
+	h := Middleware(newTestServer(t), nil)(http.HandlerFunc(echoHandler))
+
+	rec := serve(h, http.MethodPost, "/form?q=1", "hello")
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("expect pass, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(h, http.MethodGet, "/?q=attack", "")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "reqevent") {
+		t.Fatalf("expect block, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMiddlewareResponse(t *testing.T) {
+	h := Middleware(newTestServer(t), &Options{DetectResponse: true})(http.HandlerFunc(echoHandler))
+
+	rec := serve(h, http.MethodPost, "/", "public")
+	if rec.Code != http.StatusOK || rec.Body.String() != "public" || rec.Header().Get("X-Upstream") != "yes" {
+		t.Fatalf("expect pass, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(h, http.MethodPost, "/", "secret")
+	if rec.Code != 451 || !strings.Contains(rec.Body.String(), "rspevent") || rec.Header().Get("X-Upstream") != "" {
+		t.Fatalf("expect response block, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMiddlewareFailurePolicy(t *testing.T) {
+	server, err := t1k.NewFromSocketFactoryWithPoolSize(func() (net.Conn, error) {
+		return nil, errors.New("detector down")
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hookErr error
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("upstream"))
+	})
+
+	h := Middleware(server, &Options{ErrorHook: func(r *http.Request, err error) { hookErr = err }})(next)
+	rec := serve(h, http.MethodGet, "/", "")
+	if rec.Code != http.StatusServiceUnavailable || hookErr == nil {
+		t.Fatalf("expect fail closed, got %d %v", rec.Code, hookErr)
+	}
+
+	h = Middleware(server, &Options{FailOpen: true})(next)
+	rec = serve(h, http.MethodGet, "/", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "upstream" {
+		t.Fatalf("expect fail open, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMiddlewareRemovesSpool(t *testing.T) {
+	dir := t.TempDir()
+	h := Middleware(newTestServer(t), &Options{
+		PrepareContext: func(dc *detection.DetectionContext) {
+			dc.SpoolThreshold = 16
+			dc.SpoolDir = dir
+		},
+	})(http.HandlerFunc(echoHandler))
+
+	payload := strings.Repeat("0123456789", 100)
+	for _, target := range []string{"/", "/?q=attack"} {
+		serve(h, http.MethodPost, target, payload)
+		if files, _ := os.ReadDir(dir); len(files) != 0 {
+			t.Fatalf("%s: spool file not removed, %d left", target, len(files))
+		}
+	}
+}
+
+func TestMiddlewareAppliesHeadersAndCookies(t *testing.T) {
+	h := Middleware(newTestServer(t), nil)(http.HandlerFunc(echoHandler))
+
+	rec := serve(h, http.MethodGet, "/?q=cookie", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expect pass, got %d", rec.Code)
+	}
+	if rec.Header().Get("X-Waf") != "checked" || rec.Header().Get("Set-Cookie") != "sl-session=abc; Path=/" {
+		t.Fatalf("detector headers not applied: %v", rec.Header())
+	}
+}
+
+func TestMiddlewareResponseKeepsRequestCookies(t *testing.T) {
+	h := Middleware(newTestServer(t), &Options{DetectResponse: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "app", Value: "1"})
+		_, _ = io.WriteString(w, "ok")
+	}))
+
+	rec := serve(h, http.MethodGet, "/?q=cookie", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Waf") != "checked" {
+		t.Fatalf("expect pass with detector headers, got %d %v", rec.Code, rec.Header())
+	}
+	cookies := strings.Join(rec.Header()["Set-Cookie"], "\n")
+	if !strings.HasPrefix(cookies, "sl-session=abc; Path=/\napp=1") {
+		t.Fatalf("expect detector and handler cookies, got %q", cookies)
+	}
+}
+
+func TestMiddlewareBotChallenge(t *testing.T) {
+	server := newTestServer(t)
+	h := Middleware(server, nil)(http.HandlerFunc(echoHandler))
+
+	rec := serve(h, http.MethodGet, "/?q=bot-challenge", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "<html>prove you are human</html>" {
+		t.Fatalf("expect challenge, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("challenge should not be cached: %v", rec.Header())
+	}
+
+	// the answer reaches the detector and then the handler
+	var answer string
+	h = Middleware(server, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		answer = r.URL.Query().Get("sl-answer")
+		echoHandler(w, r)
+	}))
+	serve(h, http.MethodGet, "/?q=bot-challenge", "")
+	rec = serve(h, http.MethodGet, "/page?sl-answer=42", "")
+	if rec.Code != http.StatusOK || answer != "42" {
+		t.Fatalf("expect answer forwarded, got %d %q", rec.Code, answer)
+	}
+	if rec.Header().Get("Set-Cookie") != "sl-verified=1; Path=/" {
+		t.Fatalf("verified cookie not applied: %v", rec.Header())
+	}
+
+	answer = ""
+	rec = serve(h, http.MethodGet, "/page?sl-answer=7", "")
+	if answer != "" || rec.Body.String() != "<html>prove you are human</html>" {
+		t.Fatalf("expect wrong answer challenged again, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	ok, result, err := VerifyBotAnswer(server, httptest.NewRequest(http.MethodGet, "/?sl-answer=42", nil), []byte("sl-answer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || len(result.ParseCookies()) != 1 {
+		t.Fatalf("expect verified answer with cookie, got %v %+v", ok, result)
+	}
+	ok, _, err = VerifyBotAnswer(server, httptest.NewRequest(http.MethodGet, "/?sl-answer=7", nil), []byte("sl-answer"))
+	if err != nil || ok {
+		t.Fatalf("expect wrong answer rejected, got %v %v", ok, err)
+	}
+	_, _, err = VerifyBotAnswer(server, httptest.NewRequest(http.MethodGet, "/", nil), []byte("sl-answer"))
+	if !errors.Is(err, ErrNoBotAnswer) {
+		t.Fatalf("expect ErrNoBotAnswer, got %v", err)
+	}
+}
+
+func TestMiddlewareBotAnswerFailsClosed(t *testing.T) {
+	var down int32
+	var conn net.Conn
+	d := &detectortest.Detector{
+		Decide: func(sections map[t1kproto.Tag][]byte) *detectortest.Reply {
+			return &detectortest.Reply{
+				Head: '?',
+				Sections: []t1kproto.Section{
+					t1kproto.MakeSimpleSection(t1kproto.TAG_BOT_QUERY, []byte("sl-answer")),
+					t1kproto.MakeSimpleSection(t1kproto.TAG_BOT_BODY, []byte("<html>challenge</html>")),
+				},
+			}
+		},
+	}
+	server, err := t1k.NewFromSocketFactoryWithPoolSize(func() (net.Conn, error) {
+		if atomic.LoadInt32(&down) != 0 {
+			return nil, errors.New("detector down")
+		}
+		c, err := d.Dial()
+		conn = c
+		return c, err
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Middleware(server, &Options{FailOpen: true})(http.HandlerFunc(echoHandler))
+	serve(h, http.MethodGet, "/", "")
+
+	atomic.StoreInt32(&down, 1)
+	conn.Close()
+	rec := serve(h, http.MethodGet, "/?sl-answer=42", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expect unverified answer refused, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,162 @@
+package t1khttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/detection"
+)
+
+var (
+	errBlocked      = errors.New("t1k: request blocked by detector")
+	errDetectFailed = errors.New("t1k: request detection failed")
+)
+
+// detectTransport refuses to forward requests which were blocked, or whose
+// detection failed with FailOpen unset, by the Director hook.
+type detectTransport struct {
+	next http.RoundTripper
+}
+
+func (t *detectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	state, _ := req.Context().Value(contextKey{}).(*detectionState)
+	if state != nil && (state.blocked != nil || state.err != nil) {
+		// RoundTrip must close the body even on errors, this also
+		// removes its spool file
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		if state.blocked != nil {
+			return nil, errBlocked
+		}
+		return nil, errDetectFailed
+	}
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(req)
+}
+
+// InstallReverseProxy hooks proxy so that every request is detected before
+// it is forwarded and every response before it is returned, sharing one
+// DetectionContext, so the T1KContext of the request result is carried to
+// response detection. Blocked requests never reach the upstream, blocked
+// responses are replaced with the block response of opts.BlockHandler.
+//
+// The hooks wrap the Director or Rewrite, ModifyResponse, ErrorHandler and
+// Transport already set on proxy, so install them once after configuring
+// it.
+func InstallReverseProxy(proxy *httputil.ReverseProxy, server *t1k.Server, opts *Options) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if !installRewrite(proxy, server, opts) {
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			// detect before director rewrites the request for the upstream
+			state := &detectionState{}
+			*req = *req.WithContext(context.WithValue(req.Context(), contextKey{}, state))
+			state.detectRequest(server, opts, req)
+			if director != nil {
+				director(req)
+			}
+		}
+	}
+
+	proxy.Transport = &detectTransport{next: proxy.Transport}
+
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(rsp *http.Response) error {
+		if modifyResponse != nil {
+			if err := modifyResponse(rsp); err != nil {
+				return err
+			}
+		}
+		state, _ := rsp.Request.Context().Value(contextKey{}).(*detectionState)
+		if state == nil || state.result == nil {
+			// request detection failed open
+			return nil
+		}
+		return state.detectResponse(server, opts, rsp)
+	}
+
+	errorHandler := proxy.ErrorHandler
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		state, _ := r.Context().Value(contextKey{}).(*detectionState)
+		switch {
+		case errors.Is(err, errBlocked) && state != nil:
+			opts.block(w, r, state.dc, state.blocked)
+		case errors.Is(err, errDetectFailed):
+			writeFailure(w)
+		case errorHandler != nil:
+			errorHandler(w, r, err)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+}
+
+func (state *detectionState) detectRequest(server *t1k.Server, opts *Options, req *http.Request) {
+	dc, err := detection.MakeContextWithRequest(req)
+	if err == nil {
+		if opts.PrepareContext != nil {
+			opts.PrepareContext(dc)
+		}
+		state.dc = dc
+		state.result, err = server.DetectRequestInCtx(dc)
+	}
+	if err != nil {
+		if opts.ErrorHook != nil {
+			opts.ErrorHook(req, err)
+		}
+		if !opts.FailOpen {
+			state.err = err
+		}
+		return
+	}
+	if state.result.Blocked() || state.result.IsBotChallenge() {
+		state.blocked = state.result
+	}
+}
+
+func (state *detectionState) detectResponse(server *t1k.Server, opts *Options, rsp *http.Response) error {
+	detection.MakeHttpResponseInCtx(rsp, state.dc)
+	result, err := server.DetectResponseInCtx(state.dc)
+	if err != nil {
+		if opts.ErrorHook != nil {
+			opts.ErrorHook(rsp.Request, err)
+		}
+		if opts.FailOpen {
+			opts.applyResponse(rsp, state.result)
+			return nil
+		}
+		state.err = err
+		return errDetectFailed
+	}
+	state.rspResult = result
+	if result.Passed() && !result.IsBotChallenge() {
+		opts.applyResponse(rsp, state.result)
+		opts.applyResponse(rsp, result)
+		return nil
+	}
+
+	// replace the upstream response with the block response, which only
+	// gets the headers and cookies of the response result
+	rsp.Body.Close()
+	rec := newResponseRecorder()
+	opts.block(rec, rsp.Request, state.dc, result)
+	blockRsp := rec.response(rsp.Request)
+	rsp.Status = blockRsp.Status
+	rsp.StatusCode = blockRsp.StatusCode
+	rsp.Header = blockRsp.Header
+	rsp.Body = blockRsp.Body
+	rsp.ContentLength = blockRsp.ContentLength
+	rsp.TransferEncoding = nil
+	rsp.Trailer = nil
+	return nil
+}
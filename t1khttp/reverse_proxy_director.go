@@ -0,0 +1,15 @@
+//go:build !go1.20
+// +build !go1.20
+
+package t1khttp
+
+import (
+	"net/http/httputil"
+
+	"github.com/chaitin/t1k-go"
+)
+
+// installRewrite does nothing before Go 1.20, which has no Rewrite hook.
+func installRewrite(proxy *httputil.ReverseProxy, server *t1k.Server, opts *Options) bool {
+	return false
+}
@@ -0,0 +1,28 @@
+//go:build go1.20
+// +build go1.20
+
+package t1khttp
+
+import (
+	"context"
+	"net/http/httputil"
+
+	"github.com/chaitin/t1k-go"
+)
+
+// installRewrite hooks proxy.Rewrite and reports whether proxy has one;
+// net/http rejects a proxy that sets both Rewrite and Director.
+func installRewrite(proxy *httputil.ReverseProxy, server *t1k.Server, opts *Options) bool {
+	rewrite := proxy.Rewrite
+	if rewrite == nil {
+		return false
+	}
+	proxy.Rewrite = func(pr *httputil.ProxyRequest) {
+		// detect before rewrite changes the outbound request
+		state := &detectionState{}
+		pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), contextKey{}, state))
+		state.detectRequest(server, opts, pr.Out)
+		rewrite(pr)
+	}
+	return true
+}
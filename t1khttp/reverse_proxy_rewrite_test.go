@@ -0,0 +1,59 @@
+//go:build go1.20
+// +build go1.20
+
+package t1khttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInstallReverseProxyRewrite(t *testing.T) {
+	var upstreamHits int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&upstreamHits, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Path", r.URL.Path)
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.URL.Path = "/api" + pr.Out.URL.Path
+		},
+	}
+	InstallReverseProxy(proxy, newTestServer(t), nil)
+	if proxy.Director != nil {
+		t.Fatal("Director set along Rewrite")
+	}
+
+	rec := serve(proxy, http.MethodPost, "/form", "public")
+	if rec.Code != http.StatusOK || rec.Body.String() != "public" || rec.Header().Get("X-Path") != "/api/form" {
+		t.Fatalf("expect pass through Rewrite, got %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	rec = serve(proxy, http.MethodGet, "/?q=attack", "")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "reqevent") {
+		t.Fatalf("expect request block, got %d %q", rec.Code, rec.Body.String())
+	}
+	if hits := atomic.LoadInt64(&upstreamHits); hits != 1 {
+		t.Fatalf("blocked request reached upstream, %d hits", hits)
+	}
+
+	rec = serve(proxy, http.MethodPost, "/", "secret")
+	if rec.Code != 451 || !strings.Contains(rec.Body.String(), "rspevent") {
+		t.Fatalf("expect response block, got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,88 @@
+package t1khttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+func TestInstallReverseProxy(t *testing.T) {
+	var upstreamHits int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&upstreamHits, 1)
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	InstallReverseProxy(proxy, newTestServer(t), nil)
+
+	rec := serve(proxy, http.MethodPost, "/", "public")
+	if rec.Code != http.StatusOK || rec.Body.String() != "public" {
+		t.Fatalf("expect pass, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(proxy, http.MethodGet, "/?q=attack", "")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "reqevent") {
+		t.Fatalf("expect request block, got %d %q", rec.Code, rec.Body.String())
+	}
+	if hits := atomic.LoadInt64(&upstreamHits); hits != 1 {
+		t.Fatalf("blocked request reached upstream, %d hits", hits)
+	}
+
+	rec = serve(proxy, http.MethodPost, "/", "secret")
+	if rec.Code != 451 || !strings.Contains(rec.Body.String(), "rspevent") {
+		t.Fatalf("expect response block, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestInstallReverseProxyBlockCleanup(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	InstallReverseProxy(proxy, newTestServer(t), &Options{
+		PrepareContext: func(dc *detection.DetectionContext) {
+			dc.SpoolThreshold = 16
+			dc.SpoolDir = dir
+		},
+	})
+
+	rec := serve(proxy, http.MethodPost, "/?q=attack", strings.Repeat("0123456789", 100))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expect request block, got %d %q", rec.Code, rec.Body.String())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("blocked request body not closed, %d spool files left", len(files))
+	}
+
+	// the request passes with a cookie, the response is blocked
+	rec = serve(proxy, http.MethodPost, "/?q=cookie", "secret")
+	if rec.Code != 451 {
+		t.Fatalf("expect response block, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("X-Waf") != "" || rec.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("request result applied to the block response: %v", rec.Header())
+	}
+}